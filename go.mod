@@ -0,0 +1,3 @@
+module github.com/huangang/codex-autopatch
+
+go 1.21
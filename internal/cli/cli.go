@@ -0,0 +1,3685 @@
+// Package cli parses the command line and runs the patch, restore and
+// maintenance commands.
+package cli
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/huangang/codex-autopatch/internal/config"
+	"github.com/huangang/codex-autopatch/internal/discovery"
+	"github.com/huangang/codex-autopatch/internal/output"
+	"github.com/huangang/codex-autopatch/internal/rules"
+	"github.com/huangang/codex-autopatch/internal/sinks"
+)
+
+func patchSource(filePath string, content []byte, opts rules.Options) ([]byte, error) {
+	if !opts.FromBackup {
+		return content, nil
+	}
+	source, err := os.ReadFile(discovery.BackupPath(filePath))
+	if os.IsNotExist(err) {
+		return content, nil
+	}
+	return source, err
+}
+
+func patchFile(w io.Writer, filePath string, opts rules.Options) (string, string, bool) {
+	backupPath := discovery.BackupPath(filePath)
+	if opts.Allowlist != nil {
+		pristine, err := os.ReadFile(backupPath)
+		if err != nil {
+			pristine, err = os.ReadFile(filePath)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "[error]   %s\n", err.Error())
+			return "failed", "", false
+		}
+		if hash := discovery.SHA256Hex(pristine); !opts.Allowlist[hash] {
+			fmt.Fprintf(w, "[error]   %s: upstream bundle sha256 %s is not on the allowlist (unknown version or tampering); not patched\n", filePath, hash)
+			current, _ := os.ReadFile(filePath)
+			return "failed", discovery.SHA256Hex(current), false
+		}
+	}
+	backupMissing := false
+	if _, err := os.Stat(backupPath); os.IsNotExist(err) && opts.DryRun {
+		backupMissing = true
+	} else if os.IsNotExist(err) {
+		if err := copyFile(filePath, backupPath); err != nil {
+			fmt.Fprintf(w, "[error]   %s: cannot create the backup (%s), not patched\n", filePath, err.Error())
+			return "failed", "", false
+		}
+		fmt.Fprintf(w, "[backup]  %s\n", backupPath)
+		sinks.Publish(sinks.EventBackup, backupPath, "")
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		fmt.Fprintf(w, "[error]   %s\n", err.Error())
+		return "failed", "", false
+	}
+	source, err := patchSource(filePath, content, opts)
+	if err != nil {
+		fmt.Fprintf(w, "[error]   --from-backup: %s\n", err.Error())
+		return "failed", discovery.SHA256Hex(content), false
+	}
+	text, changes := rules.Apply(string(source), opts)
+	if output.LogLevel >= output.LevelVerbose {
+		rules.Trace(w, string(source), changes, opts)
+	}
+	changes = rules.LiveChanges(text, content, changes)
+	if opts.UnlockPlans && opts.RuleEnabled("plans") {
+		if maps := len(rules.PlanMaps(rules.UnpackText(string(source)))); maps != 1 {
+			fmt.Fprintf(w, "[note]    %s: plans rule skipped, found %d plan model maps ({plus:[...],pro:[...],team:[...]}) but needs exactly one\n", filePath, maps)
+		}
+	}
+	if len(changes) > 0 {
+		added := "has been added"
+		if opts.DryRun {
+			added = "would be added"
+		}
+		for _, model := range rules.EnsuredAdditions(string(source), opts) {
+			fmt.Fprintf(w, "[ensure]  %s was missing from the computed model list and %s (%s)\n", model, added, filePath)
+		}
+		for _, model := range rules.InjectedAdditions(string(source), opts) {
+			fmt.Fprintf(w, "[add]     %s is not referenced by the bundle and %s (%s)\n", model, added, filePath)
+		}
+	}
+
+	if len(changes) > 0 {
+		if err := rules.CheckSyntax(string(source), text); err != nil {
+			fmt.Fprintf(w, "[error]   %s: patched bundle fails the syntax check (%s), not written\n", filePath, err.Error())
+			return "failed", discovery.SHA256Hex(content), true
+		}
+	}
+	if len(changes) > 0 && opts.Paranoid {
+		if err := rules.CheckInvariants(string(source), text, opts); err != nil {
+			fmt.Fprintf(w, "[error]   %s: paranoid check failed (%s), not written\n", filePath, err.Error())
+			return "failed", discovery.SHA256Hex(content), true
+		}
+	}
+	if len(changes) > 0 && opts.DryRun {
+		if backupMissing {
+			fmt.Fprintf(w, "[dry-run] would back up %s to %s\n", filePath, backupPath)
+		}
+		fmt.Fprintf(w, "[dry-run] would patch %s (%s)\n", filePath, strings.Join(changes, ", "))
+		if opts.Diff {
+			fmt.Fprint(w, unifiedDiff(filePath, filePath+" (patched)", string(content), text))
+		}
+		before := rules.ExtractArrays(filePath, string(content))
+		after := rules.ExtractArrays(filePath, text)
+		for _, field := range []string{"apikey", "chatgpt"} {
+			if strings.Join(before.Arrays[field], ",") != strings.Join(after.Arrays[field], ",") {
+				fmt.Fprintf(w, "          %s: %s\n", field, strings.Join(after.Arrays[field], ", "))
+			}
+		}
+		for _, model := range before.AuthOnly {
+			kept := false
+			for _, remaining := range after.AuthOnly {
+				if remaining == model {
+					kept = true
+				}
+			}
+			if !kept {
+				fmt.Fprintf(w, "          auth_only: %s would no longer require ChatGPT sign-in\n", model)
+			}
+		}
+		return "dry-run", discovery.SHA256Hex(content), true
+	}
+	if len(changes) > 0 {
+		clearedReadOnly, err := writeBundle(filePath, []byte(text))
+		if err != nil {
+			fmt.Fprintf(w, "[error]   %s\n", err.Error())
+			if hint := discovery.ConfinementHint(filePath, err); hint != "" {
+				fmt.Fprintf(w, "[hint]    %s\n", hint)
+			}
+			return "failed", discovery.SHA256Hex(content), true
+		}
+		if clearedReadOnly {
+			fmt.Fprintf(w, "[note]    %s was read-only; attribute cleared for the write and restored\n", filePath)
+		}
+		if err := rules.VerifyWritten(filePath, text, changes, opts); err != nil {
+			if _, rollbackErr := writeBundle(filePath, content); rollbackErr != nil {
+				fmt.Fprintf(w, "[error]   %s: verification failed (%s) and rollback failed: %s\n", filePath, err.Error(), rollbackErr.Error())
+				return "failed", "", true
+			}
+			fmt.Fprintf(w, "[error]   %s: verification failed (%s), rolled back\n", filePath, err.Error())
+			return "failed", discovery.SHA256Hex(content), true
+		}
+		fmt.Fprintf(w, "[patched] %s (%s)\n", filePath, strings.Join(changes, ", "))
+		if opts.Diff {
+			fmt.Fprint(w, unifiedDiff(filePath, filePath+" (patched)", string(content), text))
+		}
+		syncCompressed(w, filePath, []byte(text), opts.Compressed)
+		return "patched", discovery.SHA256Hex([]byte(text)), true
+	}
+	fmt.Fprintf(w, "[skip]    %s (already compliant)\n", filePath)
+	if opts.DryRun {
+		return "compliant", discovery.SHA256Hex(content), false
+	}
+	syncCompressed(w, filePath, content, opts.Compressed)
+	return "compliant", discovery.SHA256Hex(content), false
+}
+
+var compressedSuffixes = []string{".gz", ".br"}
+
+func compressedStale(filePath, suffix string, data []byte) bool {
+	if suffix == ".gz" {
+		file, err := os.Open(filePath + suffix)
+		if err != nil {
+			return false
+		}
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			return true
+		}
+		decoded, err := io.ReadAll(reader)
+		return err != nil || !bytes.Equal(decoded, data)
+	}
+	original, err := os.ReadFile(discovery.BackupPath(filePath))
+	return err == nil && !bytes.Equal(original, data)
+}
+
+func syncCompressed(w io.Writer, filePath string, data []byte, mode string) {
+	for _, suffix := range compressedSuffixes {
+		variant := filePath + suffix
+		if _, err := os.Stat(variant); err != nil || !compressedStale(filePath, suffix, data) {
+			continue
+		}
+		if mode == "keep" {
+			fmt.Fprintf(w, "[note]    %s is stale; servers preferring it will serve the unpatched bundle\n", variant)
+			continue
+		}
+		if _, err := os.Stat(discovery.BackupPath(variant)); os.IsNotExist(err) {
+			if err := copyFile(variant, discovery.BackupPath(variant)); err != nil {
+				fmt.Fprintf(w, "[error]   %s: cannot create the backup (%s), left as is\n", variant, err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "[backup]  %s\n", discovery.BackupPath(variant))
+			sinks.Publish(sinks.EventBackup, discovery.BackupPath(variant), "")
+		}
+		if mode == "regenerate" && suffix == ".gz" {
+			var compressed bytes.Buffer
+			writer := gzip.NewWriter(&compressed)
+			_, err := writer.Write(data)
+			if closeErr := writer.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				fmt.Fprintf(w, "[error]   %s: cannot compress the patched bundle (%s), left as is\n", variant, err.Error())
+				continue
+			}
+			if _, err := writeBundle(variant, compressed.Bytes()); err != nil {
+				fmt.Fprintf(w, "[error]   %s\n", err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "[patched] %s (regenerated)\n", variant)
+			continue
+		}
+		if err := os.Remove(variant); err != nil {
+			fmt.Fprintf(w, "[error]   %s\n", err.Error())
+			continue
+		}
+		if suffix == ".br" && mode == "regenerate" {
+			fmt.Fprintf(w, "[cleanup] %s (brotli cannot be regenerated; removed so the patched JS is served)\n", variant)
+		} else {
+			fmt.Fprintf(w, "[cleanup] %s\n", variant)
+		}
+	}
+}
+
+var nonInteractive bool
+
+// setInteractive allows or forbids the terminal prompts; --non-interactive
+// forbids them even when stdin is a terminal.
+func setInteractive(enabled bool) {
+	nonInteractive = !enabled
+}
+
+func canPrompt() bool {
+	if nonInteractive {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func selectTargets(targets []string, opts rules.Options) []string {
+	selected := make([]bool, len(targets))
+	notes := make([]string, len(targets))
+	for i, target := range targets {
+		notes[i] = "unreadable"
+		if content, err := os.ReadFile(target); err == nil {
+			if _, changes := rules.Apply(string(content), opts); len(changes) > 0 {
+				selected[i] = true
+				notes[i] = "needs " + strings.Join(changes, ", ")
+			} else {
+				notes[i] = "already patched"
+			}
+		}
+	}
+	for {
+		fmt.Println("[select]  choose the bundles to patch:")
+		for i, target := range targets {
+			mark := " "
+			if selected[i] {
+				mark = "x"
+			}
+			version := discovery.TargetVersion(target)
+			if version == "" {
+				version = "-"
+			}
+			fmt.Printf("  %2d. [%s] %s %s  %s (%s)\n", i+1, mark, discovery.CatalogName(discovery.EditorForPath(target)), version, target, notes[i])
+		}
+		fmt.Print("[select]  numbers to toggle, a = all, n = none, Enter = continue: ")
+		line, err := stdinReader.ReadString('\n')
+		answer := strings.ToLower(strings.TrimSpace(line))
+		if answer == "" {
+			if err != nil {
+				fmt.Println()
+			}
+			break
+		}
+		switch answer {
+		case "a":
+			for i := range selected {
+				selected[i] = true
+			}
+		case "n":
+			for i := range selected {
+				selected[i] = false
+			}
+		default:
+			for _, field := range strings.FieldsFunc(answer, func(r rune) bool { return r == ' ' || r == ',' }) {
+				index, convErr := strconv.Atoi(field)
+				if convErr != nil || index < 1 || index > len(targets) {
+					fmt.Printf("[select]  %q is not a number from 1 to %d\n", field, len(targets))
+					continue
+				}
+				selected[index-1] = !selected[index-1]
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	chosen := []string{}
+	for i, target := range targets {
+		if selected[i] {
+			chosen = append(chosen, target)
+		}
+	}
+	return chosen
+}
+
+func confirmPatch(targets []string, opts rules.Options) bool {
+	pending := 0
+	lists := map[string][]string{}
+	order := []string{}
+	for _, target := range targets {
+		content, err := os.ReadFile(target)
+		if err != nil {
+			continue
+		}
+		if _, changes := rules.Apply(string(content), opts); len(changes) == 0 {
+			continue
+		}
+		pending++
+		models := []string{}
+		for _, model := range rules.BuildApikeyList(rules.UnpackText(string(content)), opts) {
+			models = append(models, rules.StripQuotes(model))
+		}
+		list := strings.Join(models, ", ")
+		if _, ok := lists[list]; !ok {
+			order = append(order, list)
+		}
+		lists[list] = append(lists[list], target)
+	}
+	if pending == 0 {
+		return true
+	}
+	for _, list := range order {
+		if len(order) == 1 {
+			fmt.Printf("[confirm] model list: %s\n", list)
+			continue
+		}
+		fmt.Printf("[confirm] model list for %s: %s\n", strings.Join(lists[list], ", "), list)
+	}
+	return confirm(fmt.Sprintf("[confirm] about to patch %d file(s), continue?", pending), false)
+}
+
+func confirm(question string, fallback bool) bool {
+	hint := "[y/N]"
+	if fallback {
+		hint = "[Y/n]"
+	}
+	if !canPrompt() {
+		answer := "n"
+		if fallback {
+			answer = "y"
+		}
+		fmt.Printf("%s %s %s (non-interactive)\n", question, hint, answer)
+		return fallback
+	}
+	for {
+		fmt.Printf("%s %s ", question, hint)
+		line, err := stdinReader.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		case "":
+			if err != nil {
+				fmt.Println()
+			}
+			return fallback
+		}
+		if err != nil {
+			fmt.Println()
+			return fallback
+		}
+	}
+}
+
+func resolveConflicts(targets []string, policy string, merge map[string][]string) []string {
+	state := sinks.LoadState()
+	host := sinks.HostName()
+	kept := false
+	remaining := []string{}
+	for _, target := range targets {
+		key := discovery.StateKey(target)
+		previous, ok := state.Targets[key]
+		content, err := os.ReadFile(target)
+		if !ok || err != nil || previous.Hash == "" || previous.Result == "failed" || (previous.Host != "" && previous.Host != host) {
+			remaining = append(remaining, target)
+			continue
+		}
+		current := discovery.SHA256Hex(content)
+		theirs := rules.ExtractArrays(target, string(content)).Arrays["apikey"]
+		if current == previous.Hash && previous.Result == "kept" {
+			switch policy {
+			case "overwrite":
+				remaining = append(remaining, target)
+			case "merge":
+				merge[key] = theirs
+				remaining = append(remaining, target)
+			default:
+				output.Logf("[skip]    %s (manual edits kept earlier; --on-conflict overwrite|merge to patch it)\n", target)
+			}
+			continue
+		}
+		if current == previous.Hash {
+			remaining = append(remaining, target)
+			continue
+		}
+		if original, err := os.ReadFile(discovery.BackupPath(target)); err == nil && discovery.SHA256Hex(original) == current {
+			remaining = append(remaining, target)
+			continue
+		}
+		output.Logf("[conflict] %s was edited after it was last patched (%s, now %s); apikey models: %s\n", target, previous.Hash[:12], current[:12], strings.Join(theirs, ", "))
+		choice := policy
+		if choice == "ask" && !canPrompt() {
+			output.Logln("[conflict] cannot ask (non-interactive), keeping the edits; pass --on-conflict overwrite|merge to patch anyway")
+			choice = "keep"
+		}
+		for choice == "ask" {
+			fmt.Print("[conflict] [k]eep theirs, [o]verwrite, [m]erge model lists? ")
+			line, err := stdinReader.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "k", "keep":
+				choice = "keep"
+			case "o", "overwrite":
+				choice = "overwrite"
+			case "m", "merge":
+				choice = "merge"
+			default:
+				if err != nil {
+					fmt.Println()
+					choice = "keep"
+				}
+			}
+		}
+		switch choice {
+		case "keep":
+			output.Logf("[skip]    %s (kept the manual edits)\n", target)
+			previous.Result = "kept"
+			previous.Hash = current
+			previous.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+			state.Targets[key] = previous
+			kept = true
+		case "merge":
+			merge[key] = theirs
+			remaining = append(remaining, target)
+		default:
+			remaining = append(remaining, target)
+		}
+	}
+	if kept {
+		sinks.SaveState(state)
+	}
+	return remaining
+}
+
+func patchAll(targets []string, optsFor func(int) rules.Options, concurrency int, stream bool, emit func(int, *sinks.TargetResult)) []sinks.TargetResult {
+	results := make([]sinks.TargetResult, len(targets))
+	done := make([]bool, len(targets))
+	next := 0
+	var mu sync.Mutex
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				var out io.Writer = &results[i].Out
+				if stream {
+					out = &output.LineWriter{Mu: &mu, Prefix: fmt.Sprintf("[%d/%d] ", i+1, len(targets))}
+				}
+				started := time.Now()
+				results[i].Result, results[i].Hash, results[i].Drifted = patchFile(out, targets[i], optsFor(i))
+				results[i].Duration = time.Since(started)
+				mu.Lock()
+				done[i] = true
+				for next < len(targets) && done[next] {
+					emit(next, &results[next])
+					next++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func mergeTargets(explicit, discovered []string) ([]string, map[string]string) {
+	targets := []string{}
+	sources := map[string]string{}
+	infos := map[string]os.FileInfo{}
+	add := func(target, source string) {
+		key := discovery.StateKey(target)
+		if info, err := os.Stat(target); err == nil {
+			for known, knownInfo := range infos {
+				if known != key && os.SameFile(info, knownInfo) {
+					key = known
+				}
+			}
+			if _, ok := infos[key]; !ok {
+				infos[key] = info
+			}
+		}
+		if previous, ok := sources[key]; ok {
+			if previous != source {
+				sources[key] = "explicit+auto-discovered"
+				output.Logf("[dedupe]  %s was given explicitly and auto-discovered; patching it once\n", target)
+			}
+			return
+		}
+		sources[key] = source
+		targets = append(targets, target)
+	}
+	for _, target := range explicit {
+		add(target, "explicit")
+	}
+	for _, target := range discovered {
+		add(target, "auto-discovered")
+	}
+	return targets, sources
+}
+
+func pristineText(target string) string {
+	if content, err := os.ReadFile(discovery.BackupPath(target)); err == nil {
+		return rules.UnpackText(string(content))
+	}
+	content, err := os.ReadFile(target)
+	if err != nil {
+		return ""
+	}
+	return rules.UnpackText(string(content))
+}
+
+func deprecatedModels(target string, previous, ensured []string) []string {
+	advertised := map[string]struct{}{}
+	for _, model := range rules.CandidateModels(pristineText(target)) {
+		advertised[rules.NormalizeName(model)] = struct{}{}
+	}
+	for _, model := range ensured {
+		advertised[rules.NormalizeName(model)] = struct{}{}
+	}
+	deprecated := []string{}
+	for _, model := range previous {
+		if _, ok := advertised[rules.NormalizeName(model)]; !ok {
+			deprecated = append(deprecated, model)
+		}
+	}
+	return deprecated
+}
+
+func trackUpstreamModels(state *sinks.RunState, targets []string) {
+	for _, target := range targets {
+		editor := discovery.EditorForPath(target)
+		version := discovery.TargetVersion(target)
+		current := rules.CandidateModels(pristineText(target))
+		previous, seen := state.Upstream[editor]
+		if seen && version != "" && previous.Version != "" && rules.CompareVersions(version, previous.Version) < 0 {
+			continue
+		}
+		label := "extension"
+		if version != "" {
+			label = "extension " + version
+		}
+		if seen {
+			added, removed := rules.ModelSetDiff(previous.Models, current)
+			if len(added) > 0 {
+				output.Logf("[upstream] %s adds %s (%s)\n", label, strings.Join(added, ", "), discovery.CatalogName(editor))
+			}
+			if len(removed) > 0 {
+				output.Logf("[upstream] %s removes %s (%s)\n", label, strings.Join(removed, ", "), discovery.CatalogName(editor))
+			}
+		}
+		state.Upstream[editor] = sinks.UpstreamModels{Version: version, Models: current}
+	}
+}
+
+type checkFinding struct {
+	path    string
+	rule    string
+	level   string
+	message string
+}
+
+func checkTargets(targets []string, opts rules.Options) ([]checkFinding, bool) {
+	findings := []checkFinding{}
+	compliant := true
+	for _, target := range targets {
+		content, err := os.ReadFile(target)
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			compliant = false
+			continue
+		}
+		_, changes := rules.Apply(string(content), opts)
+		for _, change := range changes {
+			findings = append(findings, checkFinding{path: target, rule: change, level: "error", message: rules.Descriptions[change]})
+		}
+		for _, anchor := range rules.MissingAnchors(rules.UnpackText(string(content))) {
+			if !opts.RuleEnabled(anchor) {
+				continue
+			}
+			findings = append(findings, checkFinding{path: target, rule: "missing-anchor", level: "warning", message: fmt.Sprintf("%s anchor not found", anchor)})
+		}
+		if len(changes) > 0 {
+			compliant = false
+			output.Logf("[drift]   %s (needs: %s)\n", target, strings.Join(changes, ", "))
+		} else {
+			output.Logf("[ok]      %s (compliant)\n", target)
+		}
+	}
+	return findings, compliant
+}
+
+func listTargets(targets []string, opts rules.Options) {
+	rows := [][]string{{"EDITOR", "VERSION", "BACKUP", "STATUS", "PATH"}}
+	for _, target := range targets {
+		backup := "no"
+		status := "compliant"
+		if _, err := os.Stat(discovery.BackupPath(target)); err == nil {
+			backup = "yes"
+			status = "patched"
+		}
+		if content, err := os.ReadFile(target); err != nil {
+			status = "unreadable"
+		} else if _, changes := rules.Apply(string(content), opts); len(changes) > 0 {
+			status = "unpatched (" + strings.Join(changes, ", ") + ")"
+		}
+		version := discovery.TargetVersion(target)
+		if version == "" {
+			version = "-"
+		}
+		editor := discovery.EditorForPath(target)
+		if editor == "" {
+			editor = "-"
+		}
+		rows = append(rows, []string{editor, version, backup, status, target})
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	for _, row := range rows {
+		line := ""
+		for i, cell := range row[:len(row)-1] {
+			line += cell + strings.Repeat(" ", widths[i]-len(cell)+2)
+		}
+		fmt.Println(line + row[len(row)-1])
+	}
+}
+
+var webviewCaches = []string{filepath.Join("Service Worker", "CacheStorage"), filepath.Join("Service Worker", "ScriptCache"), "CachedData"}
+
+func recoverTargets(targets []string, opts rules.Options) int {
+	cleared := map[string]bool{}
+	failed := false
+	for _, target := range targets {
+		output.Logf("[recover] %s\n", target)
+		content, err := os.ReadFile(target)
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			failed = true
+			continue
+		}
+		text := string(content)
+		original, bakErr := os.ReadFile(discovery.BackupPath(target))
+		broken := false
+		if _, err := rules.ScanJS(text); err != nil {
+			if bakErr != nil {
+				output.Logf("[verify]  does not parse (%s); with no backup to compare, this may also be a tokenizer limit\n", err.Error())
+			} else if _, bakParse := rules.ScanJS(string(original)); bakParse == nil {
+				output.Logf("[verify]  does not parse (%s) although the backup does; the bundle is damaged\n", err.Error())
+				broken = true
+			}
+		} else {
+			output.Logln("[verify]  parses cleanly")
+		}
+		if missing := rules.MissingAnchors(rules.UnpackText(text)); len(missing) > 0 {
+			output.Logf("[verify]  model arrays missing: %s\n", strings.Join(missing, ", "))
+			broken = true
+		}
+		if _, changes := rules.Apply(text, opts); len(changes) > 0 {
+			output.Logf("[verify]  not patched (%s)\n", strings.Join(changes, ", "))
+		}
+
+		if bakErr != nil {
+			output.Logln("[compare] no .bak backup; the bundle cannot be restored locally")
+		} else if discovery.SHA256Hex(original) == discovery.SHA256Hex(content) {
+			output.Logln("[compare] identical to the backup, so the patch is not what broke the editor")
+		} else {
+			output.Logf("[compare] backup %d bytes, live %d bytes\n", len(original), len(content))
+			output.Logf("[compare] apikey in backup: %s\n", strings.Join(rules.ExtractArrays(target, string(original)).Arrays["apikey"], ", "))
+			output.Logf("[compare] apikey now:       %s\n", strings.Join(rules.ExtractArrays(target, text).Arrays["apikey"], ", "))
+			if confirm("[restore] put the original bundle back from the backup?", broken) {
+				if restore([]string{discovery.BackupPath(target)}, "", false) != 0 {
+					failed = true
+				}
+			}
+		}
+
+		for _, root := range discovery.Roots() {
+			if root.UserData == "" || !strings.HasPrefix(discovery.StateKey(target), root.Path+string(filepath.Separator)) {
+				continue
+			}
+			caches := []string{}
+			for _, cache := range webviewCaches {
+				dir := filepath.Join(root.UserData, cache)
+				if _, err := os.Stat(dir); err == nil && !cleared[dir] {
+					caches = append(caches, dir)
+				}
+			}
+			if len(caches) == 0 || !confirm(fmt.Sprintf("[cache]   clear the webview cache of %s (%s)? Close the editor first", discovery.CatalogName(root.Editor), root.UserData), true) {
+				continue
+			}
+			for _, dir := range caches {
+				cleared[dir] = true
+				if err := os.RemoveAll(dir); err != nil {
+					output.Logf("[error]   %s\n", err.Error())
+					failed = true
+					continue
+				}
+				output.Logf("[cleared] %s\n", dir)
+			}
+		}
+
+		version := discovery.TargetVersion(target)
+		if version == "" || !confirm(fmt.Sprintf("[vsix]    download a fresh openai.chatgpt %s from the marketplace to reinstall?", version), false) {
+			continue
+		}
+		dir := discovery.DataPath("vsix")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			failed = true
+			continue
+		}
+		vsixPath, err := downloadVsix(&http.Client{Timeout: 2 * time.Minute}, version, dir)
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			failed = true
+			continue
+		}
+		cli := "code"
+		for _, candidate := range discovery.EditorCLIs {
+			if candidate[1] == discovery.EditorForPath(target) {
+				cli = candidate[0]
+			}
+		}
+		output.Logf("[vsix]    %s; install it with: %s --install-extension \"%s\" --force\n", vsixPath, cli, vsixPath)
+	}
+	output.Logln(output.Say("恢复流程结束。请完全退出并重新打开编辑器；如仍无法加载，请重新安装插件。", "Recovery finished. Quit and reopen the editor completely; if the extension still fails to load, reinstall it."))
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func fileURI(filePath string) string {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		absPath = filePath
+	}
+	slashed := filepath.ToSlash(absPath)
+	if !strings.HasPrefix(slashed, "/") {
+		slashed = "/" + slashed
+	}
+	return (&url.URL{Scheme: "file", Path: slashed}).String()
+}
+
+func writeSarif(sarifPath string, findings []checkFinding) error {
+	type message struct {
+		Text string `json:"text"`
+	}
+	type sarifRule struct {
+		ID               string  `json:"id"`
+		ShortDescription message `json:"shortDescription"`
+	}
+	type artifactLocation struct {
+		URI string `json:"uri"`
+	}
+	type physicalLocation struct {
+		ArtifactLocation artifactLocation `json:"artifactLocation"`
+	}
+	type location struct {
+		PhysicalLocation physicalLocation `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	ruleIDs := make([]string, 0, len(rules.Descriptions))
+	for id := range rules.Descriptions {
+		ruleIDs = append(ruleIDs, id)
+	}
+	sort.Strings(ruleIDs)
+	sarifRules := []sarifRule{}
+	for _, id := range ruleIDs {
+		sarifRules = append(sarifRules, sarifRule{ID: id, ShortDescription: message{Text: rules.Descriptions[id]}})
+	}
+	results := []result{}
+	for _, finding := range findings {
+		results = append(results, result{
+			RuleID:    finding.rule,
+			Level:     finding.level,
+			Message:   message{Text: finding.message},
+			Locations: []location{{PhysicalLocation: physicalLocation{ArtifactLocation: artifactLocation{URI: fileURI(finding.path)}}}},
+		})
+	}
+	log := map[string]any{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []any{map[string]any{
+			"tool": map[string]any{"driver": map[string]any{
+				"name":           "codex-autopatch",
+				"informationUri": "https://github.com/huangang/codex-autopatch",
+				"rules":          sarifRules,
+			}},
+			"results": results,
+		}},
+	}
+	encoded, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sarifPath, encoded, 0o644)
+}
+
+var outputSchemas = map[string]string{
+	"plan": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "codex-autopatch plan (--plan)",
+  "type": "object",
+  "required": ["hash", "entries"],
+  "properties": {
+    "hash": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+    "entries": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["path", "original_sha256", "patched_sha256", "changes"],
+        "properties": {
+          "path": {"type": "string"},
+          "original_sha256": {"type": "string"},
+          "patched_sha256": {"type": "string"},
+          "changes": {"type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}`,
+	"arrays": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "codex-autopatch extracted arrays (--print-original / --print-patched)",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "required": ["path", "arrays", "auth_only", "default_model_order"],
+    "properties": {
+      "path": {"type": "string"},
+      "arrays": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}},
+      "references": {"type": "object", "additionalProperties": {"type": "string"}},
+      "auth_only": {"type": "array", "items": {"type": "string"}},
+      "default_model_order": {"type": "array", "items": {"type": "string"}},
+      "provenance": {"type": "object", "additionalProperties": {"type": "array", "items": {"enum": ["bundle-scan", "default-order", "deprecation-kept", "add-model", "ensure-models"]}}}
+    }
+  }
+}`,
+	"stats": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "codex-autopatch run summary (--stats-json)",
+  "type": "object",
+  "required": ["hosts", "users", "targets", "patched", "compliant", "failed", "drifted", "bytes_written", "duration_ms", "elapsed_ms"],
+  "properties": {
+    "hosts": {"type": "array", "items": {"type": "string"}},
+    "users": {"type": "array", "items": {"type": "string"}},
+    "targets": {"type": "integer"},
+    "patched": {"type": "integer"},
+    "compliant": {"type": "integer"},
+    "failed": {"type": "integer"},
+    "drifted": {"type": "integer"},
+    "bytes_written": {"type": "integer"},
+    "duration_ms": {
+      "type": "object",
+      "properties": {"p50": {"type": "number"}, "p90": {"type": "number"}, "p99": {"type": "number"}, "max": {"type": "number"}}
+    },
+    "elapsed_ms": {"type": "number"}
+  }
+}`,
+	"state": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "codex-autopatch state (~/.codex-autopatch/state.json)",
+  "type": "object",
+  "required": ["targets"],
+  "properties": {
+    "targets": {
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "required": ["result", "sha256", "updated_at"],
+        "properties": {
+          "result": {"enum": ["patched", "compliant", "failed", "kept"]},
+          "sha256": {"type": "string"},
+          "updated_at": {"type": "string", "format": "date-time"},
+          "host": {"type": "string"},
+          "os": {"type": "string"},
+          "editor": {"type": "string"},
+          "source": {"type": "string"},
+          "backup_version": {"type": "string"},
+          "last_known_good": {"type": "string", "description": "sha256 of the content saved as <file>.good by --mark-good"},
+          "last_known_good_at": {"type": "string", "format": "date-time"},
+          "duration_ms": {"type": "number"}
+        }
+      }
+    },
+    "models": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}},
+    "counters": {
+      "type": "object",
+      "properties": {
+        "runs": {"type": "integer"},
+        "patched": {"type": "integer"},
+        "failed": {"type": "integer"},
+        "drift": {"type": "integer"},
+        "last_success": {"type": "string", "format": "date-time"}
+      }
+    },
+    "upstream": {
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "required": ["models"],
+        "properties": {
+          "version": {"type": "string"},
+          "models": {"type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}`,
+	"events": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "codex-autopatch run event (jsonl sink line; the webhook sink posts an array of these)",
+  "type": "object",
+  "required": ["time", "host", "action"],
+  "properties": {
+    "time": {"type": "string", "format": "date-time"},
+    "host": {"type": "string"},
+    "action": {"enum": ["discovered", "backup", "patched", "compliant", "failed", "restored", "undone", "completed"]},
+    "path": {"type": "string", "description": "absent on completed"},
+    "editor": {"type": "string"},
+    "sha256": {"type": "string"},
+    "backup": {"type": "string"}
+  }
+}`,
+	"manifest": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "codex-autopatch install manifest line (--manifest, one JSON object per line)",
+  "type": "object",
+  "required": ["time", "host", "action", "path"],
+  "properties": {
+    "time": {"type": "string", "format": "date-time"},
+    "host": {"type": "string"},
+    "user": {"type": "string"},
+    "action": {"enum": ["patched", "restored", "undone"]},
+    "path": {"type": "string"},
+    "sha256": {"type": "string"},
+    "backup": {"type": "string"}
+  }
+}`,
+	"verify": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "codex-autopatch verify findings (--check --sarif)",
+  "$ref": "https://json.schemastore.org/sarif-2.1.0.json"
+}`,
+}
+
+func printSchemas(names []string) int {
+	if len(names) == 0 {
+		for name := range outputSchemas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	documents := map[string]json.RawMessage{}
+	for _, name := range names {
+		schema, ok := outputSchemas[name]
+		if !ok {
+			output.Logf("[error]   unknown schema %s\n", name)
+			return exitUsage
+		}
+		documents[name] = json.RawMessage(schema)
+	}
+	encoded, err := json.MarshalIndent(documents, "", "  ")
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	fmt.Println(string(encoded))
+	return 0
+}
+
+type planEntry struct {
+	Path         string   `json:"path"`
+	OriginalHash string   `json:"original_sha256"`
+	PatchedHash  string   `json:"patched_sha256"`
+	Changes      []string `json:"changes"`
+}
+
+type patchPlan struct {
+	Hash    string      `json:"hash"`
+	Entries []planEntry `json:"entries"`
+}
+
+func buildPlan(targets []string, opts rules.Options) (patchPlan, error) {
+	entries := []planEntry{}
+	for _, target := range targets {
+		content, err := os.ReadFile(target)
+		if err != nil {
+			return patchPlan{}, err
+		}
+		absPath, err := filepath.Abs(target)
+		if err != nil {
+			absPath = target
+		}
+		source, err := patchSource(target, content, opts)
+		if err != nil {
+			return patchPlan{}, fmt.Errorf("--from-backup: %s", err.Error())
+		}
+		text, changes := rules.Apply(string(source), opts)
+		entries = append(entries, planEntry{
+			Path:         absPath,
+			OriginalHash: discovery.SHA256Hex(content),
+			PatchedHash:  discovery.SHA256Hex([]byte(text)),
+			Changes:      rules.LiveChanges(text, content, changes),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		return patchPlan{}, err
+	}
+	return patchPlan{Hash: discovery.SHA256Hex(encoded), Entries: entries}, nil
+}
+
+func reloadHint(editor string) string {
+	shortcut := "Ctrl+Shift+P"
+	if runtime.GOOS == "darwin" {
+		shortcut = "Cmd+Shift+P"
+	}
+	for _, entry := range discovery.EditorCatalog {
+		if entry.Editor != editor {
+			continue
+		}
+		name := entry.Name
+		if name == "" {
+			name = entry.Editor
+		}
+		if entry.Remote {
+			return fmt.Sprintf(output.Say("%s（远程）：在连接到本机的客户端窗口中按 %s → Developer: Reload Window", "%s (remote): press %s → Developer: Reload Window in the client window connected to this machine"), name, shortcut)
+		}
+		return fmt.Sprintf(output.Say("%s：按 %s → Developer: Reload Window，或重启 %s", "%s: press %s → Developer: Reload Window, or restart %s"), name, shortcut, name)
+	}
+	return output.Say("其他编辑器：请重启加载该扩展的编辑器", "Other editors: restart the editor that loads the extension")
+}
+
+func printCompletion(editors []string) {
+	if len(editors) == 0 {
+		output.Logln(output.Say("操作完成。没有文件被修改，无需重新加载。", "Done. No files were changed, so nothing needs reloading."))
+		return
+	}
+	output.Logln(output.Say("操作完成。请重新加载以下编辑器以加载新资源：", "Done. Reload these editors to pick up the new assets:"))
+	seen := map[string]struct{}{}
+	for _, editor := range editors {
+		if _, ok := seen[editor]; ok {
+			continue
+		}
+		seen[editor] = struct{}{}
+		output.Logf("  - %s\n", reloadHint(editor))
+	}
+}
+
+func restoreDestination(dir, original string) string {
+	if extDir := discovery.ExtensionDirFor(original); extDir != "" {
+		if rel, err := filepath.Rel(filepath.Dir(extDir), original); err == nil {
+			return filepath.Join(dir, rel)
+		}
+	}
+	return filepath.Join(dir, filepath.Base(original))
+}
+
+func restore(bakFiles []string, dest string, force bool) int {
+	state := sinks.LoadState()
+	var targets []string
+	if len(bakFiles) > 0 {
+		targets = bakFiles
+	} else {
+		targets = discovery.AutoDiscoverBaks()
+	}
+	if len(targets) == 0 {
+		output.Logln(output.Say("没有找到可恢复的 .bak 文件。", "No .bak files found to restore."))
+		return exitNoTargets
+	}
+	failed := false
+	for _, bakPath := range targets {
+		if _, err := os.Stat(bakPath); err != nil {
+			output.Logf("[error]   %s does not exist\n", bakPath)
+			failed = true
+			continue
+		}
+		original := discovery.BackupOriginal(bakPath)
+		if dest != "" {
+			copied := restoreDestination(dest, original)
+			if err := os.MkdirAll(filepath.Dir(copied), 0o755); err != nil {
+				output.Logf("[error]   %s\n", err.Error())
+				failed = true
+				continue
+			}
+			if err := copyFile(bakPath, copied); err != nil {
+				output.Logf("[error]   %s\n", err.Error())
+				failed = true
+				continue
+			}
+			output.Logf("[restored] %s <- %s\n", copied, bakPath)
+			continue
+		}
+		if !force {
+			live := discovery.TargetVersion(original)
+			backup := state.Targets[discovery.StateKey(original)].BackupVersion
+			if live != "" && backup != "" && rules.CompareVersions(live, backup) > 0 {
+				output.Logf("[error]   %s: backup was taken from extension %s but %s is now installed; restoring an old bundle into a newer extension breaks the webview. Reinstall the extension instead, or pass --force\n", bakPath, backup, live)
+				failed = true
+				continue
+			}
+		}
+		if _, err := os.Stat(original); err == nil {
+			snapshot := original + ".pre-restore"
+			if err := copyFile(original, snapshot); err != nil {
+				output.Logf("[error]   %s: cannot snapshot before restoring (%s), left as is\n", original, err.Error())
+				failed = true
+				continue
+			}
+			output.Logf("[snapshot] %s\n", snapshot)
+		}
+		if err := copyFile(bakPath, original); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			failed = true
+			continue
+		}
+		output.Logf("[restored] %s <- %s\n", original, bakPath)
+		for _, suffix := range compressedSuffixes {
+			if _, err := os.Stat(discovery.BackupPath(original + suffix)); err == nil {
+				if err := copyFile(discovery.BackupPath(original+suffix), original+suffix); err != nil {
+					output.Logf("[error]   %s\n", err.Error())
+					failed = true
+					continue
+				}
+				output.Logf("[restored] %s <- %s\n", original+suffix, discovery.BackupPath(original+suffix))
+			}
+		}
+		sinks.Publish(sinks.EventRestored, original, bakPath)
+	}
+	if dest == "" {
+		output.Logln(output.Say("提示：如仍异常，建议重新安装插件或手动替换原文件。", "Tip: if something is still wrong, reinstall the extension or replace the original file by hand."))
+	}
+	if failed {
+		return exitRestoreFailed
+	}
+	return exitOK
+}
+
+func markGood(targets []string) int {
+	state := sinks.LoadState()
+	marked := 0
+	for _, target := range targets {
+		content, err := os.ReadFile(target)
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			continue
+		}
+		if _, err := writeBundle(target+".good", content); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			continue
+		}
+		key := discovery.StateKey(target)
+		entry := state.Targets[key]
+		entry.GoodHash = discovery.SHA256Hex(content)
+		entry.GoodAt = time.Now().UTC().Format(time.RFC3339)
+		state.Targets[key] = entry
+		output.Logf("[good]    %s (sha256 %s)\n", target, entry.GoodHash[:12])
+		marked++
+	}
+	sinks.SaveState(state)
+	if marked == 0 {
+		return 1
+	}
+	return 0
+}
+
+func restoreLastKnownGood(paths []string) int {
+	state := sinks.LoadState()
+	targets := paths
+	if len(targets) == 0 {
+		targets = discovery.AutoDiscover()
+	}
+	recorded := 0
+	failed := false
+	for _, target := range targets {
+		entry := state.Targets[discovery.StateKey(target)]
+		if entry.GoodHash == "" {
+			if len(paths) > 0 {
+				output.Logf("[error]   %s has no last known good content; record one with --mark-good\n", target)
+				failed = true
+			}
+			continue
+		}
+		recorded++
+		content, err := os.ReadFile(target + ".good")
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			failed = true
+			continue
+		}
+		if discovery.SHA256Hex(content) != entry.GoodHash {
+			output.Logf("[error]   %s.good does not match the recorded last known good hash %s; refusing to restore it\n", target, entry.GoodHash[:12])
+			failed = true
+			continue
+		}
+		if current, err := os.ReadFile(target); err == nil {
+			if discovery.SHA256Hex(current) == entry.GoodHash {
+				output.Logf("[skip]    %s already matches last known good (%s)\n", target, entry.GoodAt)
+				continue
+			}
+			snapshot := target + ".pre-restore"
+			if err := copyFile(target, snapshot); err != nil {
+				output.Logf("[error]   %s: cannot snapshot before restoring (%s), left as is\n", target, err.Error())
+				failed = true
+				continue
+			}
+			output.Logf("[snapshot] %s\n", snapshot)
+		}
+		if err := copyFile(target+".good", target); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			failed = true
+			continue
+		}
+		output.Logf("[restored] %s <- %s.good (last known good, %s)\n", target, target, entry.GoodAt)
+		sinks.Publish(sinks.EventRestored, target, target+".good")
+	}
+	if recorded == 0 && len(paths) == 0 {
+		output.Logln(output.Say("没有找到记录了 last known good 的文件。请先使用 --mark-good 标记。", "No files with a recorded last known good. Mark one with --mark-good first."))
+		return exitNoTargets
+	}
+	if failed {
+		return exitRestoreFailed
+	}
+	return exitOK
+}
+
+func writeRestoreScript(target string) (string, error) {
+	base := filepath.Base(target)
+	saved := func(name string) string {
+		if discovery.BackupDir == "" {
+			return name + ".bak"
+		}
+		return discovery.BackupPath(filepath.Join(filepath.Dir(target), name))
+	}
+	lines := []string{}
+	scriptPath := target + ".restore.sh"
+	if runtime.GOOS == "windows" {
+		scriptPath = target + ".restore.ps1"
+		quote := func(name string) string { return "'" + strings.ReplaceAll(name, "'", "''") + "'" }
+		lines = append(lines,
+			"# Restores the original bundle saved by codex-autopatch; does not need the codex-autopatch binary.",
+			"$ErrorActionPreference = 'Stop'",
+			"Set-Location -LiteralPath $PSScriptRoot",
+			"Copy-Item -LiteralPath "+quote(saved(base))+" -Destination "+quote(base)+" -Force")
+		for _, suffix := range compressedSuffixes {
+			lines = append(lines, "if (Test-Path -LiteralPath "+quote(saved(base+suffix))+") { Copy-Item -LiteralPath "+quote(saved(base+suffix))+" -Destination "+quote(base+suffix)+" -Force }")
+		}
+		lines = append(lines, "Write-Output "+quote("restored "+target))
+	} else {
+		quote := func(name string) string { return "'" + strings.ReplaceAll(name, "'", `'\''`) + "'" }
+		lines = append(lines,
+			"#!/bin/sh",
+			"# Restores the original bundle saved by codex-autopatch; does not need the codex-autopatch binary.",
+			"set -e",
+			`cd "$(dirname "$0")"`,
+			"cp -f "+quote(saved(base))+" "+quote(base))
+		for _, suffix := range compressedSuffixes {
+			lines = append(lines, "if [ -f "+quote(saved(base+suffix))+" ]; then cp -f "+quote(saved(base+suffix))+" "+quote(base+suffix)+"; fi")
+		}
+		lines = append(lines, "echo "+quote("restored "+target))
+	}
+	return scriptPath, os.WriteFile(scriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0o755)
+}
+
+func undoRestore(paths []string) int {
+	originals := []string{}
+	if len(paths) > 0 {
+		for _, item := range paths {
+			originals = append(originals, strings.TrimSuffix(item, ".pre-restore"))
+		}
+	} else {
+		for _, bakPath := range discovery.AutoDiscoverBaks() {
+			originals = append(originals, discovery.BackupOriginal(bakPath))
+		}
+	}
+	undone := 0
+	failed := false
+	for _, original := range originals {
+		snapshot := original + ".pre-restore"
+		if _, err := os.Stat(snapshot); err != nil {
+			if len(paths) > 0 {
+				output.Logf("[error]   %s does not exist\n", snapshot)
+				failed = true
+			}
+			continue
+		}
+		if err := copyFile(snapshot, original); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			failed = true
+			continue
+		}
+		if err := os.Remove(snapshot); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+		}
+		output.Logf("[undone]  %s <- %s\n", original, snapshot)
+		sinks.Publish(sinks.EventUndone, original, "")
+		undone++
+	}
+	if undone == 0 {
+		output.Logln(output.Say("没有找到可撤销的恢复快照（.pre-restore）。", "No restore snapshots (.pre-restore) found to undo."))
+		return exitNoTargets
+	}
+	if failed {
+		return exitRestoreFailed
+	}
+	return exitOK
+}
+
+const marketplaceURL = "https://marketplace.visualstudio.com/_apis/public/gallery"
+
+func marketplacePlatform() string {
+	osName := map[string]string{"windows": "win32", "linux": "linux", "darwin": "darwin"}[runtime.GOOS]
+	arch := map[string]string{"amd64": "x64", "arm64": "arm64"}[runtime.GOARCH]
+	if osName == "" || arch == "" {
+		return ""
+	}
+	return osName + "-" + arch
+}
+
+func latestMarketplaceVersion(client *http.Client) (string, error) {
+	body := `{"filters":[{"criteria":[{"filterType":7,"value":"openai.chatgpt"}]}],"flags":914}`
+	req, err := http.NewRequest(http.MethodPost, marketplaceURL+"/extensionquery", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json;api-version=6.0-preview.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("marketplace query failed: HTTP %d", resp.StatusCode)
+	}
+	var result struct {
+		Results []struct {
+			Extensions []struct {
+				Versions []struct {
+					Version string `json:"version"`
+				} `json:"versions"`
+			} `json:"extensions"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Results) == 0 || len(result.Results[0].Extensions) == 0 || len(result.Results[0].Extensions[0].Versions) == 0 {
+		return "", fmt.Errorf("marketplace returned no versions for openai.chatgpt")
+	}
+	return result.Results[0].Extensions[0].Versions[0].Version, nil
+}
+
+func downloadVsix(client *http.Client, version, dir string) (string, error) {
+	url := fmt.Sprintf("%s/publishers/openai/vsextensions/chatgpt/%s/vspackage", marketplaceURL, version)
+	if platform := marketplacePlatform(); platform != "" {
+		url += "?targetPlatform=" + platform
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		data, err = io.ReadAll(reader)
+		if err != nil {
+			return "", err
+		}
+	}
+	vsixPath := filepath.Join(dir, fmt.Sprintf("openai.chatgpt-%s.vsix", version))
+	if err := os.WriteFile(vsixPath, data, 0o644); err != nil {
+		return "", err
+	}
+	return vsixPath, nil
+}
+
+func vsixBundles(vsixPath string) (map[string]string, error) {
+	reader, err := zip.OpenReader(vsixPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	bundles := map[string]string{}
+	for _, file := range reader.File {
+		if match, _ := path.Match("extension/webview/assets/index-*.js", file.Name); !match {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		bundles[file.Name] = string(content)
+	}
+	return bundles, nil
+}
+
+func checkUpstream() int {
+	client := &http.Client{Timeout: 2 * time.Minute}
+	latest, err := latestMarketplaceVersion(client)
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	newest := ""
+	for _, version := range discovery.InstalledVersions() {
+		if newest == "" || rules.CompareVersions(version, newest) > 0 {
+			newest = version
+		}
+	}
+	if newest != "" && rules.CompareVersions(latest, newest) <= 0 {
+		output.Logf("[upstream] installed %s is up to date (marketplace %s)\n", newest, latest)
+		return 0
+	}
+
+	dir, err := runTempDir()
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	defer cleanupRunTemp()
+	vsixPath, err := downloadVsix(client, latest, dir)
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	bundles, err := vsixBundles(vsixPath)
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	if len(bundles) == 0 {
+		output.Logf("[upstream] %s: no webview/assets/index-*.js in vsix, patch will break\n", latest)
+		return 1
+	}
+	names := make([]string, 0, len(bundles))
+	for name := range bundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	broken := true
+	for _, name := range names {
+		missing := rules.MissingAnchors(rules.UnpackText(bundles[name]))
+		if len(missing) < 3 {
+			broken = false
+		}
+		if len(missing) == 0 {
+			output.Logf("[upstream] %s %s: all rules match\n", latest, path.Base(name))
+		} else {
+			output.Logf("[upstream] %s %s: missing anchors (%s)\n", latest, path.Base(name), strings.Join(missing, ", "))
+		}
+	}
+	if broken {
+		output.Logf("[upstream] %s will break the patch; stay on %s or wait for a script update\n", latest, newest)
+		return 1
+	}
+	output.Logf("[upstream] %s is available (installed %s) and can be patched\n", latest, newest)
+	return 0
+}
+
+func writeBundle(filePath string, data []byte) (bool, error) {
+	if resolved, err := filepath.EvalSymlinks(filePath); err == nil {
+		filePath = resolved
+	}
+	mode := os.FileMode(0o644)
+	clearedReadOnly := false
+	if info, err := os.Stat(filePath); err == nil {
+		mode = info.Mode().Perm()
+		// Windows refuses to rename over a read-only file; the new file gets the
+		// read-only mode back before it takes its place.
+		if mode&0o200 == 0 {
+			if err := os.Chmod(filePath, mode|0o200); err != nil {
+				return false, fmt.Errorf("%s is read-only and cannot be made writable: %s", filePath, err.Error())
+			}
+			clearedReadOnly = true
+		}
+	}
+	temp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-")
+	if err != nil {
+		if clearedReadOnly {
+			os.Chmod(filePath, mode)
+		}
+		return clearedReadOnly, err
+	}
+	fail := func(err error) (bool, error) {
+		temp.Close()
+		os.Remove(temp.Name())
+		if clearedReadOnly {
+			os.Chmod(filePath, mode)
+		}
+		return clearedReadOnly, err
+	}
+	if _, err := temp.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := temp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := temp.Close(); err != nil {
+		return fail(err)
+	}
+	if err := os.Chmod(temp.Name(), mode); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(temp.Name(), filePath); err != nil {
+		return fail(err)
+	}
+	if dir, err := os.Open(filepath.Dir(filePath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return clearedReadOnly, nil
+}
+
+var (
+	tempBase  string
+	runTemp   string
+	runTempMu sync.Mutex
+)
+
+// setTempDir moves the run's scratch files under dir; empty means the system temp dir.
+func setTempDir(dir string) {
+	tempBase = dir
+}
+
+func tempRoot() string {
+	if tempBase != "" {
+		return tempBase
+	}
+	return os.TempDir()
+}
+
+func runTempDir() (string, error) {
+	runTempMu.Lock()
+	defer runTempMu.Unlock()
+	if runTemp != "" {
+		return runTemp, nil
+	}
+	if err := os.MkdirAll(tempRoot(), 0o755); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(tempRoot(), "codex-autopatch-")
+	if err != nil {
+		return "", err
+	}
+	runTemp = dir
+	return dir, nil
+}
+
+func cleanupRunTemp() {
+	runTempMu.Lock()
+	defer runTempMu.Unlock()
+	if runTemp != "" {
+		os.RemoveAll(runTemp)
+		runTemp = ""
+	}
+}
+
+func cleanupOrphanTemps() {
+	entries, err := os.ReadDir(tempRoot())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "codex-autopatch-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < time.Hour {
+			continue
+		}
+		orphan := filepath.Join(tempRoot(), entry.Name())
+		if err := os.RemoveAll(orphan); err == nil {
+			output.Logf("[cleanup] removed stale temp dir %s\n", orphan)
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	_, err = writeBundle(dst, data)
+	return err
+}
+
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+			return now.Add(-time.Duration(days) * 24 * time.Hour), nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use a duration like 24h or 7d, or a date like 2006-01-02", value)
+}
+
+var modeFlags = []string{"--restore", "--mark-good", "--check", "--print-original", "--print-patched", "--plan", "--apply-plan", "--check-upstream", "--json-schema"}
+
+var flagRequires = map[string]string{"--allowlist": "--enforce-allowlist", "--sarif": "--check", "--undo-last": "--restore", "--to": "--restore", "--force": "--restore", "--last-known-good": "--restore", "--metrics-listen": "--watch"}
+
+var ruleFlags = []string{"--preset", "--models", "--order", "--pin-first", "--add-model", "--exclude-model", "--include-mini", "--unlock-plans", "--paranoid", "--from-backup", "--auth-only-keep", "--ensure-models", "--profile-name", "--filter", "--enforce-allowlist"}
+
+var runFlags = []string{"--changed-only", "--output", "--concurrency", "--prune-deprecated", "--watch", "--stats-json", "--jobs", "--nice", "--io-idle", "--verify-after", "--restore-script", "--on-conflict", "--metrics-file", "--metrics-listen", "--dry-run", "--diff", "--select"}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func statStamp(target string) (fileStamp, bool) {
+	info, err := os.Stat(target)
+	if err != nil {
+		return fileStamp{}, false
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, true
+}
+
+func lowerPriority(nice int, ioIdle bool) {
+	pid := strconv.Itoa(os.Getpid())
+	commands := [][]string{}
+	if runtime.GOOS == "windows" {
+		if nice > 0 || ioIdle {
+			commands = append(commands, []string{"powershell", "-NoProfile", "-Command", "(Get-Process -Id " + pid + ").PriorityClass = 'Idle'"})
+		}
+	} else {
+		if nice > 0 {
+			commands = append(commands, []string{"renice", "-n", strconv.Itoa(nice), "-p", pid})
+		}
+		if ioIdle && runtime.GOOS == "linux" {
+			commands = append(commands, []string{"ionice", "-c", "3", "-p", pid})
+		}
+	}
+	for _, command := range commands {
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			output.Logf("[note]    could not lower priority with %s: %s %s\n", command[0], err.Error(), strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+func watchTargets(interval time.Duration, initial []string, collect func() []string, run func([]string), stop <-chan struct{}) {
+	seen := map[string]fileStamp{}
+	settled := map[string]fileStamp{}
+	written := map[string]string{}
+	remember := func(target string) {
+		if stamp, ok := statStamp(target); ok {
+			seen[target] = stamp
+			settled[target] = stamp
+		}
+		if content, err := os.ReadFile(target); err == nil {
+			written[target] = discovery.SHA256Hex(content)
+		}
+	}
+	for _, target := range initial {
+		remember(target)
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		changed := []string{}
+		for _, target := range collect() {
+			stamp, ok := statStamp(target)
+			if !ok {
+				continue
+			}
+			if last, known := seen[target]; !known || last != stamp {
+				seen[target] = stamp
+				continue
+			}
+			if settled[target] == stamp {
+				continue
+			}
+			content, err := os.ReadFile(target)
+			if err != nil {
+				continue
+			}
+			if discovery.SHA256Hex(content) == written[target] {
+				settled[target] = stamp
+				continue
+			}
+			changed = append(changed, target)
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		for _, target := range changed {
+			output.Logf("[watch]   %s changed\n", target)
+		}
+		run(changed)
+		for _, target := range changed {
+			remember(target)
+			remember(discovery.BackupPath(target))
+		}
+	}
+}
+
+func validateFlags(given map[string]bool) error {
+	modes := []string{}
+	for _, flag := range modeFlags {
+		if given[flag] {
+			modes = append(modes, flag)
+		}
+	}
+	if len(modes) > 1 {
+		return fmt.Errorf("%s cannot be combined", strings.Join(modes, " and "))
+	}
+	for flag, required := range flagRequires {
+		if given[flag] && !given[required] {
+			return fmt.Errorf("%s only applies to %s", flag, required)
+		}
+	}
+	if given["--select"] && given["--non-interactive"] {
+		return fmt.Errorf("--select cannot be combined with --non-interactive")
+	}
+	for _, flag := range []string{"--watch", "--verify-after", "--mark-good"} {
+		if given["--dry-run"] && given[flag] {
+			return fmt.Errorf("--dry-run cannot be combined with %s", flag)
+		}
+	}
+	for _, flag := range []string{"--include-mini", "--filter", "--ensure-models", "--exclude-model", "--add-model", "--order", "--pin-first"} {
+		if given["--models"] && given[flag] {
+			return fmt.Errorf("--models cannot be combined with %s, which only shapes the computed list", flag)
+		}
+	}
+	if given["--quiet"] && given["--verbose"] {
+		return fmt.Errorf("--quiet cannot be combined with --verbose")
+	}
+	if given["--to"] && given["--undo-last"] {
+		return fmt.Errorf("--to cannot be combined with --undo-last")
+	}
+	if given["--last-known-good"] && (given["--to"] || given["--undo-last"]) {
+		return fmt.Errorf("--last-known-good cannot be combined with --to or --undo-last")
+	}
+	mode := ""
+	if len(modes) == 1 {
+		mode = modes[0]
+	}
+	for _, flag := range ruleFlags {
+		if given[flag] && (mode == "--restore" || mode == "--mark-good" || mode == "--check-upstream" || mode == "--json-schema") {
+			return fmt.Errorf("%s has no effect with %s", flag, mode)
+		}
+	}
+	for _, flag := range runFlags {
+		if given[flag] && mode != "" && mode != "--apply-plan" {
+			return fmt.Errorf("%s only applies when patching, not with %s", flag, mode)
+		}
+	}
+	return nil
+}
+
+func explainFlags(settings [][2]string) {
+	width := 0
+	for _, setting := range settings {
+		if len(setting[0]) > width {
+			width = len(setting[0])
+		}
+	}
+	for _, setting := range settings {
+		value := setting[1]
+		if value == "" {
+			value = "-"
+		}
+		output.Logf("[explain] %-*s = %s\n", width, setting[0], value)
+	}
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func expandFileArg(arg string) ([]string, error) {
+	if _, err := os.Lstat(arg); err == nil {
+		return []string{arg}, nil
+	}
+	expanded := arg
+	if arg == "~" || strings.HasPrefix(arg, "~/") || (runtime.GOOS == "windows" && strings.HasPrefix(arg, `~\`)) {
+		home := discovery.UserHomeDir()
+		if home == "" {
+			return nil, fmt.Errorf("cannot expand %s: home directory unknown", arg)
+		}
+		expanded = filepath.Join(home, arg[1:])
+	}
+	if !strings.ContainsAny(expanded, "*?[") {
+		return []string{expanded}, nil
+	}
+	matches, err := filepath.Glob(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %s", arg, err.Error())
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("pattern %s matched no files", arg)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func launchEditor(command []string) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		output.Logf("[error]   %s\n", err.Error())
+		return 127
+	}
+	return 0
+}
+
+const (
+	exitOK            = 0
+	exitPartial       = 1
+	exitNoTargets     = 2
+	exitRestoreFailed = 3
+	exitListenFailed  = 4
+	exitUsage         = 64
+)
+
+var subcommands = []string{"patch", "restore", "list", "status", "diff", "doctor", "recover"}
+
+var legacyModeFlags = [][2]string{{"--restore", "restore"}, {"--check", "status"}}
+
+func diffSegments(text string) []string {
+	segments := []string{}
+	last := 0
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' || text[i] == ';' {
+			segments = append(segments, text[last:i+1])
+			last = i + 1
+		}
+	}
+	if last < len(text) {
+		segments = append(segments, text[last:])
+	}
+	return segments
+}
+
+type diffOp struct {
+	kind byte
+	text string
+}
+
+func diffOps(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ops := []diffOp{}
+	for _, segment := range a[:prefix] {
+		ops = append(ops, diffOp{' ', segment})
+	}
+	ops = append(ops, myersOps(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, segment := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', segment})
+	}
+	return ops
+}
+
+func myersOps(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	trace := [][]int{}
+	for d := 0; d <= n+m && d <= 2000; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+		}
+		trace = append(trace, append([]int{}, v[offset-d:offset+d+1]...))
+		if v[offset+n-m] >= n && (n-m+d)%2 == 0 && n-m >= -d && n-m <= d {
+			return myersBacktrack(a, b, trace)
+		}
+	}
+	ops := []diffOp{}
+	for _, segment := range a {
+		ops = append(ops, diffOp{'-', segment})
+	}
+	for _, segment := range b {
+		ops = append(ops, diffOp{'+', segment})
+	}
+	return ops
+}
+
+func myersBacktrack(a, b []string, trace [][]int) []diffOp {
+	reversed := []diffOp{}
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		previous := trace[d-1]
+		at := func(k int) int { return previous[k+d-1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if prevK == k+1 {
+			reversed = append(reversed, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			reversed = append(reversed, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, diffOp{' ', a[x-1]})
+		x--
+		y--
+	}
+	ops := make([]diffOp, 0, len(reversed))
+	for i := len(reversed) - 1; i >= 0; i-- {
+		ops = append(ops, reversed[i])
+	}
+	return ops
+}
+
+const diffWidth = 240
+
+func trimSegment(text string, from, to int) string {
+	text = strings.TrimSuffix(text, "\n")
+	if len(text) <= diffWidth {
+		return text
+	}
+	from, to = max(from-60, 0), min(to+60, len(text))
+	if from >= to {
+		from, to = 0, min(diffWidth, len(text))
+	}
+	trimmed := text[from:to]
+	if from > 0 {
+		trimmed = "…" + trimmed
+	}
+	if to < len(text) {
+		trimmed += "…"
+	}
+	return trimmed
+}
+
+func unifiedDiff(oldName, newName, before, after string) string {
+	ops := diffOps(diffSegments(before), diffSegments(after))
+	const context = 2
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	oldLine, newLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.kind != '+' {
+			oldLine[i+1]++
+		}
+		if op.kind != '-' {
+			newLine[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := max(i-context, 0)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		stop := min(end+context, len(ops))
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldLine[start]+1, oldLine[stop]-oldLine[start], newLine[start]+1, newLine[stop]-newLine[start])
+		removed, added := []string{}, []string{}
+		for _, op := range ops[start:stop] {
+			if op.kind == '-' {
+				removed = append(removed, op.text)
+			} else if op.kind == '+' {
+				added = append(added, op.text)
+			}
+		}
+		for j, op := range ops[start:stop] {
+			index := start + j
+			text := op.text
+			switch {
+			case op.kind == ' ' && index < i:
+				text = trimSegment(text, len(text)-diffWidth/2, len(text))
+			case op.kind == ' ':
+				text = trimSegment(text, 0, diffWidth/2)
+			default:
+				pair := ""
+				list, position := removed, 0
+				if op.kind == '+' {
+					list = added
+				}
+				for position < len(list) && list[position] != op.text {
+					position++
+				}
+				if len(removed) == len(added) && op.kind == '-' {
+					pair = added[position]
+				} else if len(removed) == len(added) {
+					pair = removed[position]
+				}
+				prefix, suffix := 0, 0
+				for prefix < len(text) && prefix < len(pair) && text[prefix] == pair[prefix] {
+					prefix++
+				}
+				for suffix < len(text)-prefix && suffix < len(pair)-prefix && text[len(text)-1-suffix] == pair[len(pair)-1-suffix] {
+					suffix++
+				}
+				if pair == "" {
+					prefix, suffix = 0, len(text)-diffWidth
+				}
+				text = trimSegment(text, prefix, len(text)-suffix)
+			}
+			fmt.Fprintf(&out, "%c%s\n", op.kind, text)
+		}
+		i = stop
+	}
+	return out.String()
+}
+
+func diffTargets(targets []string, opts rules.Options) int {
+	for _, target := range targets {
+		content, err := os.ReadFile(target)
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			return 1
+		}
+		before := string(content)
+		after, changes := rules.Apply(before, opts)
+		oldName, newName := target, target+" (patched)"
+		if len(changes) == 0 {
+			original, err := os.ReadFile(discovery.BackupPath(target))
+			if err != nil || string(original) == before {
+				output.Logf("[diff]    %s: no changes\n", target)
+				continue
+			}
+			before, after = string(original), before
+			oldName, newName = discovery.BackupPath(target), target
+		}
+		fmt.Print(unifiedDiff(oldName, newName, before, after))
+	}
+	return 0
+}
+
+func fileAttributes(file string) []string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+	attributes := []string{}
+	if info.Mode().Perm()&0o200 == 0 {
+		attributes = append(attributes, "read-only")
+	}
+	if runtime.GOOS != "windows" {
+		return attributes
+	}
+	// attrib prints the set attribute letters in front of the path, e.g. "A  SH   C:\...".
+	out, err := exec.Command("attrib", file).Output()
+	if err != nil {
+		return attributes
+	}
+	line := strings.TrimSpace(string(out))
+	if index := strings.Index(strings.ToLower(line), strings.ToLower(file)); index > 0 {
+		flags := line[:index]
+		if strings.Contains(flags, "H") {
+			attributes = append(attributes, "hidden")
+		}
+		if strings.Contains(flags, "S") {
+			attributes = append(attributes, "system")
+		}
+	}
+	return attributes
+}
+
+func attributeHint(attributes []string) string {
+	if runtime.GOOS != "windows" {
+		return "chmod u+w"
+	}
+	flags := map[string]string{"read-only": "-R", "hidden": "-H", "system": "-S"}
+	command := []string{"attrib"}
+	for _, attribute := range attributes {
+		command = append(command, flags[attribute])
+	}
+	return strings.Join(command, " ")
+}
+
+func doctor(targets []string, opts rules.Options) int {
+	problems := 0
+	output.Logf("[doctor]  %s/%s, home %s\n", runtime.GOOS, runtime.GOARCH, discovery.UserHomeDir())
+	if dir := filepath.Dir(discovery.StatePath()); discovery.StatePath() == "" {
+		output.Logln("[doctor]  no home directory, so state, config and the discovery cache are disabled")
+		problems++
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		output.Logf("[doctor]  data dir %s is not writable: %s\n", dir, err.Error())
+		problems++
+	} else if probe, err := os.CreateTemp(dir, ".doctor-"); err != nil {
+		output.Logf("[doctor]  data dir %s is not writable: %s\n", dir, err.Error())
+		problems++
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+		output.Logf("[doctor]  data dir %s is writable\n", dir)
+	}
+	if _, err := os.Stat(discovery.ConfigPath()); err == nil {
+		if config.Lint(discovery.ConfigPath()) != 0 {
+			problems++
+		}
+	} else {
+		output.Logf("[doctor]  no config file at %s; defaults apply\n", discovery.ConfigPath())
+	}
+	missing := 0
+	for _, root := range discovery.Roots() {
+		if info, err := os.Stat(root.Path); err == nil && info.IsDir() {
+			output.Logf("[doctor]  %s extensions: %s\n", discovery.CatalogName(root.Editor), root.Path)
+		} else {
+			missing++
+		}
+	}
+	output.Logf("[doctor]  %d known extension locations do not exist on this machine\n", missing)
+	if len(targets) == 0 {
+		output.Logln("[doctor]  no Codex bundle found; install openai.chatgpt, or point at it with --extensions-dir or --scan")
+		return 1
+	}
+	listTargets(targets, opts)
+	state := sinks.LoadState()
+	for _, target := range targets {
+		for _, file := range []string{target, discovery.BackupPath(target)} {
+			if attributes := fileAttributes(file); len(attributes) > 0 {
+				output.Logf("[doctor]  %s is %s; clear it with %s if patch or restore fails\n", file, strings.Join(attributes, ", "), attributeHint(attributes))
+				problems++
+			}
+		}
+		if probe, err := os.CreateTemp(filepath.Dir(target), ".doctor-"); err != nil {
+			output.Logf("[doctor]  %s is not writable, so the bundle cannot be replaced: %s\n", filepath.Dir(target), err.Error())
+			problems++
+		} else {
+			probe.Close()
+			os.Remove(probe.Name())
+		}
+		live := discovery.TargetVersion(target)
+		backup := state.Targets[discovery.StateKey(target)].BackupVersion
+		if _, err := os.Stat(discovery.BackupPath(target)); err == nil && live != "" && backup != "" && rules.CompareVersions(live, backup) > 0 {
+			output.Logf("[doctor]  %s was taken from extension %s but %s is installed; do not restore it\n", discovery.BackupPath(target), backup, live)
+			problems++
+		}
+	}
+	if problems > 0 {
+		output.Logf("[doctor]  %d problem(s) found\n", problems)
+		return 1
+	}
+	output.Logln("[doctor]  no problems found")
+	return 0
+}
+
+type cliOptions struct {
+	command  string
+	launch   []string
+	files    []string
+	auto     bool
+	given    map[string]bool
+	opts     rules.Options
+	explain  bool
+	schema   bool
+	upstream bool
+
+	restore       bool
+	restoreTo     string
+	force         bool
+	undoLast      bool
+	lastKnownGood bool
+	markGood      bool
+	check         bool
+	sarifFile     string
+	printMode     string
+	plan          bool
+	approvedPlan  string
+
+	configFile       string
+	profileName      string
+	presetName       string
+	includeMini      bool
+	unlockPlans      bool
+	authOnlyKeep     []string
+	ensureModels     []string
+	models           []string
+	addModels        []string
+	order            *rules.ModelOrder
+	pinFirst         []string
+	excludeModels    []rules.ModelPattern
+	filter           *rules.ModelFilter
+	allowlistFile    string
+	enforceAllowlist bool
+	pruneDeprecated  bool
+	jobsFile         string
+
+	flagDirs        map[string]string
+	dirOverrides    map[string]string
+	extraDirs       []discovery.Root
+	scanDirs        []string
+	editors         []string
+	discoverCLI     bool
+	wsl             bool
+	includeInactive bool
+	allVersions     bool
+	allUsers        bool
+	noCache         bool
+	newerThan       time.Time
+	catalogFile     string
+	specsFile       string
+	assumedVersion  string
+
+	perMachine     bool
+	tempDir        string
+	backupDir      string
+	language       string
+	manifest       string
+	logLevel       int
+	assumeYes      bool
+	nonInteractive bool
+	pickTargets    bool
+	restoreScripts bool
+	niceLevel      int
+	ioIdle         bool
+	verifyAfter    time.Duration
+	onConflict     string
+	changedOnly    bool
+	outputMode     string
+	concurrency    int
+	statsFile      string
+	metricsFile    string
+	metricsListen  string
+	watchInterval  time.Duration
+
+	cfg        config.Config
+	cfgPath    string
+	envNames   []string
+	jobConfigs map[string]config.Config
+}
+
+func parseArgs(args []string) (cliOptions, error) {
+	cli := cliOptions{
+		command:      "patch",
+		given:        map[string]bool{},
+		opts:         rules.Options{Disabled: map[string]bool{}, Compressed: "regenerate"},
+		flagDirs:     map[string]string{},
+		dirOverrides: map[string]string{},
+		manifest:     sinks.DefaultManifestPath(),
+		logLevel:     output.LevelNormal,
+		language:     output.Language,
+		niceLevel:    -1,
+		outputMode:   "grouped",
+		concurrency:  runtime.NumCPU(),
+	}
+	if len(args) >= 1 {
+		for _, name := range subcommands {
+			if args[0] == name {
+				cli.command = name
+				args = args[1:]
+				break
+			}
+		}
+	}
+	switch cli.command {
+	case "restore":
+		args = append([]string{"--restore"}, args...)
+	case "status":
+		args = append([]string{"--check"}, args...)
+	}
+	if len(args) >= 1 && args[0] == "exec" {
+		dash := -1
+		for i, arg := range args {
+			if arg == "--" {
+				dash = i
+				break
+			}
+		}
+		if dash < 0 || dash == len(args)-1 {
+			return cli, fmt.Errorf("usage: exec [options] -- <editor command> [args...]")
+		}
+		cli.launch = args[dash+1:]
+		args = args[1:dash]
+	}
+
+	expanded := []string{}
+	for _, arg := range args {
+		if name, value, ok := strings.Cut(arg, "="); ok && strings.HasPrefix(name, "--") {
+			expanded = append(expanded, name, value)
+			continue
+		}
+		expanded = append(expanded, arg)
+	}
+	args = expanded
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "--") {
+			cli.given[arg] = true
+		}
+		switch arg {
+		case "--auto":
+			cli.auto = true
+		case "--stats-json":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--stats-json requires a file path or -")
+			}
+			i++
+			cli.statsFile = args[i]
+		case "--metrics-file":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--metrics-file requires a file path (node_exporter textfile collector, e.g. codex_autopatch.prom)")
+			}
+			i++
+			cli.metricsFile = args[i]
+		case "--metrics-listen":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--metrics-listen requires an address like 127.0.0.1:9464")
+			}
+			i++
+			cli.metricsListen = args[i]
+		case "--jobs":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--jobs requires a file path")
+			}
+			i++
+			cli.jobsFile = args[i]
+		case "--explain-flags":
+			cli.explain = true
+		case "--watch":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--watch requires a polling interval like 10s")
+			}
+			i++
+			value, err := time.ParseDuration(args[i])
+			if err != nil || value < time.Second {
+				return cli, fmt.Errorf("invalid --watch interval: %s (use 1s or more)", args[i])
+			}
+			cli.watchInterval = value
+		case "--restore":
+			cli.restore = true
+		case "--to":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--to requires a directory")
+			}
+			i++
+			cli.restoreTo = args[i]
+		case "--force":
+			cli.force = true
+		case "--undo-last":
+			cli.undoLast = true
+		case "--last-known-good":
+			cli.lastKnownGood = true
+		case "--mark-good":
+			cli.markGood = true
+		case "--include-mini":
+			cli.includeMini = true
+		case "--unlock-plans":
+			cli.unlockPlans = true
+		case "--paranoid":
+			cli.opts.Paranoid = true
+		case "--from-backup":
+			cli.opts.FromBackup = true
+		case "--assume-extension-version":
+			if i+1 >= len(args) || !regexp.MustCompile(`^\d+(\.\d+)*$`).MatchString(args[i+1]) {
+				return cli, fmt.Errorf("--assume-extension-version requires a version like 0.4.12")
+			}
+			i++
+			cli.assumedVersion = args[i]
+		case "--compressed":
+			if i+1 >= len(args) || (args[i+1] != "regenerate" && args[i+1] != "delete" && args[i+1] != "keep") {
+				return cli, fmt.Errorf("--compressed requires regenerate, delete or keep")
+			}
+			i++
+			cli.opts.Compressed = args[i]
+		case "--include-inactive":
+			cli.includeInactive = true
+		case "--all-versions":
+			cli.allVersions = true
+		case "--vscode-ext-dir", "--insiders-ext-dir", "--cursor-ext-dir":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("%s requires a directory", arg)
+			}
+			i++
+			cli.flagDirs[map[string]string{"--vscode-ext-dir": "vscode", "--insiders-ext-dir": "vscode-insiders", "--cursor-ext-dir": "cursor"}[arg]] = args[i]
+		case "--extensions-dir", "--server-data-dir":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("%s requires a directory", arg)
+			}
+			i++
+			dir, err := filepath.Abs(args[i])
+			if err != nil {
+				return cli, err
+			}
+			editor := "custom"
+			if arg == "--server-data-dir" {
+				dir = filepath.Join(dir, "extensions")
+				editor = "code-server"
+			}
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				return cli, fmt.Errorf("%s %s: %s is not a directory", arg, args[i], dir)
+			}
+			cli.extraDirs = append(cli.extraDirs, discovery.Root{Editor: editor, Path: dir})
+		case "--nice":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--nice requires a level from 0 to 19")
+			}
+			i++
+			value, err := strconv.Atoi(args[i])
+			if err != nil || value < 0 || value > 19 {
+				return cli, fmt.Errorf("invalid --nice level: %s (use 0 to 19)", args[i])
+			}
+			cli.niceLevel = value
+		case "--verify-after":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--verify-after requires a delay like 30s")
+			}
+			i++
+			value, err := time.ParseDuration(args[i])
+			if err != nil || value <= 0 {
+				return cli, fmt.Errorf("invalid --verify-after delay: %s", args[i])
+			}
+			cli.verifyAfter = value
+		case "--on-conflict":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--on-conflict requires one of %s", strings.Join(config.ConflictPolicies, ", "))
+			}
+			i++
+			if !config.ValidConflictPolicy(args[i]) {
+				return cli, fmt.Errorf("invalid --on-conflict policy: %s (use %s)", args[i], strings.Join(config.ConflictPolicies, ", "))
+			}
+			cli.onConflict = args[i]
+		case "--io-idle":
+			cli.ioIdle = true
+		case "--filter":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--filter requires an expression like 'version >= 5.1 && !contains(name, \"nano\")'")
+			}
+			i++
+			parsed, err := rules.ParseFilter(args[i])
+			if err != nil {
+				return cli, err
+			}
+			cli.filter = parsed
+		case "--preset":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--preset requires a preset name like max-only, codex-family, everything or conservative")
+			}
+			i++
+			cli.presetName = args[i]
+		case "--order":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--order requires newest, oldest or a comma-separated model list")
+			}
+			i++
+			parsed, err := rules.ParseModelOrder(strings.Split(args[i], ","), "--order")
+			if err != nil {
+				return cli, err
+			}
+			cli.order = &parsed
+		case "--pin-first":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--pin-first requires a comma-separated model list")
+			}
+			i++
+			list, err := rules.ParseModelList(args[i], "--pin-first")
+			if err != nil {
+				return cli, err
+			}
+			cli.pinFirst = list
+		case "--add-model":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--add-model requires a model id like gpt-5.2-codex-max")
+			}
+			i++
+			list, err := rules.ParseModelList(args[i], "--add-model")
+			if err != nil {
+				return cli, err
+			}
+			cli.addModels = append(cli.addModels, list...)
+		case "--exclude-model":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--exclude-model requires a glob like '*-mini' or a regex like '/^gpt-5-/'")
+			}
+			i++
+			pattern, err := rules.ParseModelPattern(args[i])
+			if err != nil {
+				return cli, fmt.Errorf("--exclude-model: %s", err.Error())
+			}
+			cli.excludeModels = append(cli.excludeModels, pattern)
+		case "--scan":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--scan requires a directory")
+			}
+			i++
+			if info, err := os.Stat(args[i]); err != nil || !info.IsDir() {
+				return cli, fmt.Errorf("--scan %s is not a directory", args[i])
+			}
+			cli.scanDirs = append(cli.scanDirs, args[i])
+		case "--allowlist":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--allowlist requires a file path")
+			}
+			i++
+			cli.allowlistFile = args[i]
+		case "--enforce-allowlist":
+			cli.enforceAllowlist = true
+		case "--restore-script":
+			cli.restoreScripts = true
+		case "--per-machine":
+			cli.perMachine = true
+		case "--backup-dir":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--backup-dir requires a directory")
+			}
+			i++
+			cli.backupDir = args[i]
+		case "--lang":
+			if i+1 >= len(args) || !output.ValidLanguage(args[i+1]) {
+				return cli, fmt.Errorf("--lang requires one of %s", strings.Join(output.Languages, ", "))
+			}
+			i++
+			cli.language = args[i]
+		case "--all-users":
+			cli.allUsers = true
+		case "--dry-run":
+			cli.opts.DryRun = true
+		case "--non-interactive":
+			cli.nonInteractive = true
+		case "--select":
+			cli.pickTargets = true
+		case "--yes", "-y":
+			cli.assumeYes = true
+		case "--quiet", "-q":
+			cli.given["--quiet"] = true
+			cli.logLevel = output.LevelQuiet
+		case "--verbose", "-v":
+			cli.given["--verbose"] = true
+			cli.logLevel = output.LevelVerbose
+		case "--diff":
+			cli.opts.Diff = true
+		case "--no-cache":
+			cli.noCache = true
+		case "--discover-cli":
+			cli.discoverCLI = true
+		case "--wsl":
+			if runtime.GOOS != "windows" {
+				return cli, fmt.Errorf("--wsl is only available on Windows; inside a distro run the Linux binary with --auto")
+			}
+			cli.wsl = true
+		case "--editor":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--editor requires a comma-separated list of editor ids")
+			}
+			i++
+			for _, item := range strings.Split(args[i], ",") {
+				if strings.TrimSpace(item) != "" {
+					cli.editors = append(cli.editors, strings.TrimSpace(item))
+				}
+			}
+		case "--ensure-models":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--ensure-models requires a comma-separated model list")
+			}
+			i++
+			cli.ensureModels = []string{}
+			for _, item := range strings.Split(args[i], ",") {
+				if strings.TrimSpace(item) != "" {
+					cli.ensureModels = append(cli.ensureModels, strings.TrimSpace(item))
+				}
+			}
+		case "--models":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--models requires a comma-separated model list")
+			}
+			i++
+			list, err := rules.ParseModelList(args[i], "--models")
+			if err != nil {
+				return cli, err
+			}
+			cli.models = list
+		case "--auth-only-keep":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--auth-only-keep requires a comma-separated model list")
+			}
+			i++
+			cli.authOnlyKeep = []string{}
+			for _, item := range strings.Split(args[i], ",") {
+				if strings.TrimSpace(item) != "" {
+					cli.authOnlyKeep = append(cli.authOnlyKeep, strings.TrimSpace(item))
+				}
+			}
+		case "--config":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--config requires a file path")
+			}
+			i++
+			cli.configFile = args[i]
+		case "--manifest":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--manifest requires a file path")
+			}
+			i++
+			cli.manifest = args[i]
+		case "--profile-name":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--profile-name requires a profile name")
+			}
+			i++
+			cli.profileName = args[i]
+		case "--json-schema":
+			cli.schema = true
+		case "--check-upstream":
+			cli.upstream = true
+		case "--changed-only":
+			cli.changedOnly = true
+		case "--output":
+			if i+1 >= len(args) || (args[i+1] != "grouped" && args[i+1] != "stream") {
+				return cli, fmt.Errorf("--output requires grouped or stream")
+			}
+			i++
+			cli.outputMode = args[i]
+		case "--concurrency":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--concurrency requires a number")
+			}
+			i++
+			value, err := strconv.Atoi(args[i])
+			if err != nil || value < 1 {
+				return cli, fmt.Errorf("invalid --concurrency value: %s", args[i])
+			}
+			cli.concurrency = value
+		case "--discovery-spec":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--discovery-spec requires a file path")
+			}
+			i++
+			cli.specsFile = args[i]
+		case "--temp-dir":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--temp-dir requires a directory")
+			}
+			i++
+			cli.tempDir = args[i]
+		case "--catalog":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--catalog requires a file path")
+			}
+			i++
+			cli.catalogFile = args[i]
+		case "--only-newer-than":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--only-newer-than requires a duration (24h, 7d) or a date")
+			}
+			i++
+			value, err := parseSince(args[i], time.Now())
+			if err != nil {
+				return cli, err
+			}
+			cli.newerThan = value
+		case "--prune-deprecated":
+			cli.pruneDeprecated = true
+		case "--check":
+			cli.check = true
+		case "--sarif":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--sarif requires a file path")
+			}
+			i++
+			cli.sarifFile = args[i]
+		case "--print-original":
+			cli.printMode = "original"
+		case "--print-patched":
+			cli.printMode = "patched"
+		case "--plan":
+			cli.plan = true
+		case "--apply-plan":
+			if i+1 >= len(args) {
+				return cli, fmt.Errorf("--apply-plan requires a plan hash")
+			}
+			i++
+			cli.approvedPlan = args[i]
+		default:
+			if strings.HasPrefix(arg, "--") {
+				return cli, fmt.Errorf("unknown flag %s", arg)
+			}
+			expanded, err := expandFileArg(arg)
+			if err != nil {
+				return cli, err
+			}
+			cli.files = append(cli.files, expanded...)
+		}
+	}
+
+	if err := validateFlags(cli.given); err != nil {
+		return cli, err
+	}
+	if cli.launch != nil || (cli.command != "patch" && cli.command != "restore") {
+		subcommand := cli.command
+		if cli.launch != nil {
+			subcommand = "exec"
+		}
+		for _, flag := range append(append([]string{}, modeFlags...), "--watch") {
+			if cli.given[flag] && !(cli.command == "status" && flag == "--check") {
+				return cli, fmt.Errorf("%s cannot be used with %s", flag, subcommand)
+			}
+		}
+		if len(cli.files) == 0 {
+			cli.auto = true
+		}
+	}
+	if cli.changedOnly && cli.outputMode == "stream" {
+		return cli, fmt.Errorf("--changed-only needs --output grouped: streamed lines are printed before the result is known")
+	}
+	return cli, nil
+}
+
+// install hands the resolved settings to the output, discovery and sinks packages
+// and to the prompt and temp file helpers. It runs before the config is read, so the
+// per-machine data directory is used for it, and again once the config has been applied.
+func (cli *cliOptions) install() {
+	output.SetLogLevel(cli.logLevel)
+	discovery.Configure(discovery.Settings{
+		PerMachine:      cli.perMachine,
+		AllUsers:        cli.allUsers,
+		WSL:             cli.wsl,
+		NoCache:         cli.noCache,
+		IncludeInactive: cli.includeInactive,
+		AllVersions:     cli.allVersions,
+		AssumedVersion:  cli.assumedVersion,
+		Editors:         cli.editors,
+		ExtraDirs:       cli.extraDirs,
+		DirOverrides:    cli.dirOverrides,
+	})
+	setInteractive(!cli.nonInteractive)
+	sinks.SetManifest(cli.manifest)
+	setTempDir(cli.tempDir)
+	discovery.SetBackupDir(cli.backupDir)
+	output.SetLanguage(cli.language)
+}
+
+func (cli *cliOptions) loadSettings() error {
+	if cli.configFile == "" {
+		cli.configFile = os.Getenv("CODEX_AUTOPATCH_CONFIG")
+	}
+	if cli.profileName == "" {
+		cli.profileName = os.Getenv("CODEX_AUTOPATCH_PROFILE")
+	}
+	for name, target := range map[string]*bool{"CODEX_AUTOPATCH_YES": &cli.assumeYes, "CODEX_AUTOPATCH_NON_INTERACTIVE": &cli.nonInteractive} {
+		enabled, err := config.EnvBool(name)
+		if err != nil {
+			return err
+		}
+		*target = *target || enabled
+	}
+	cli.cfgPath = cli.configFile
+	if cli.cfgPath == "" {
+		cli.cfgPath = discovery.ConfigPath()
+	}
+	cfg, err := config.Load(cli.cfgPath, cli.configFile != "")
+	if err != nil {
+		return err
+	}
+	profile := config.Config{}
+	if cli.profileName != "" {
+		profile, err = cfg.Profile(cli.profileName)
+		if err != nil {
+			return fmt.Errorf("%s: %s", cli.cfgPath, err.Error())
+		}
+	}
+	env, envNames, err := config.FromEnv()
+	if err != nil {
+		return err
+	}
+	cli.envNames = envNames
+	cliPreset := cli.presetName != ""
+	for _, source := range []string{env.Preset, profile.Preset, cfg.Preset} {
+		if cli.presetName == "" {
+			cli.presetName = source
+		}
+	}
+	preset := config.Config{}
+	if cli.presetName != "" {
+		preset, err = cfg.LookupPreset(cli.presetName)
+		if err != nil {
+			return err
+		}
+	}
+	// A preset named by the config, profile or environment is the base those layers
+	// refine; one given with --preset overrides them and only yields to other flags.
+	config.ApplyLayers(&cli.opts, preset, cliPreset, cfg, profile, env)
+	cfg = cfg.Merge(env)
+	cli.cfg = cfg
+	if cli.includeMini {
+		cli.opts.IncludeMini = true
+	}
+	if err := sinks.Open(cfg.Sinks); err != nil {
+		return err
+	}
+	if cli.backupDir == "" {
+		cli.backupDir = cfg.BackupDir
+	}
+	if cli.backupDir != "" {
+		if cli.backupDir == "~" || strings.HasPrefix(cli.backupDir, "~/") {
+			cli.backupDir = discovery.ExpandCatalogDir(discovery.UserHomeDir(), cli.backupDir)
+		}
+		absDir, err := filepath.Abs(cli.backupDir)
+		if err != nil {
+			return err
+		}
+		cli.backupDir = absDir
+	}
+	if !cli.given["--lang"] && cfg.Language != "" {
+		cli.language = cfg.Language
+	}
+	if len(cli.scanDirs) == 0 {
+		for _, dir := range cfg.ScanDirs {
+			if dir == "~" || strings.HasPrefix(dir, "~/") {
+				dir = discovery.ExpandCatalogDir(discovery.UserHomeDir(), dir)
+			}
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				output.Logf("[note]    scan directory %s does not exist, skipped\n", dir)
+				continue
+			}
+			cli.scanDirs = append(cli.scanDirs, dir)
+		}
+	}
+	if cli.statsFile == "" {
+		cli.statsFile = cfg.StatsJSON
+	}
+	if cli.verifyAfter == 0 {
+		cli.verifyAfter = cfg.VerifyAfter
+	}
+	if cli.onConflict == "" {
+		cli.onConflict = cfg.OnConflict
+	}
+	if cli.onConflict == "" {
+		cli.onConflict = "ask"
+	}
+	if cli.niceLevel < 0 && cfg.Nice != nil {
+		cli.niceLevel = *cfg.Nice
+	}
+	if cli.niceLevel < 0 && cli.watchInterval > 0 {
+		cli.niceLevel = 10
+	}
+	if !cli.given["--io-idle"] {
+		cli.ioIdle = cli.watchInterval > 0
+		if cfg.IOIdle != nil {
+			cli.ioIdle = *cfg.IOIdle
+		}
+	}
+	opts := &cli.opts
+	if cli.unlockPlans {
+		opts.UnlockPlans = true
+		opts.Disabled["plans"] = false
+	}
+	if cli.authOnlyKeep != nil {
+		opts.AuthOnlyKeep = cli.authOnlyKeep
+	}
+	if cli.ensureModels != nil {
+		opts.EnsureModels = cli.ensureModels
+	}
+	if cli.models != nil {
+		opts.Models = cli.models
+	}
+	if cli.excludeModels != nil {
+		opts.ExcludeModels = append(append([]rules.ModelPattern{}, opts.ExcludeModels...), cli.excludeModels...)
+	}
+	if cli.addModels != nil {
+		opts.AddModels = cli.addModels
+	}
+	if cli.order != nil {
+		opts.Order = *cli.order
+	}
+	if cli.pinFirst != nil {
+		opts.PinFirst = cli.pinFirst
+	}
+	if cli.filter != nil {
+		opts.Filter = cli.filter
+	}
+	if cli.enforceAllowlist {
+		if cli.allowlistFile == "" {
+			cli.allowlistFile = discovery.DataPath("allowlist.txt")
+		}
+		allowed, err := config.LoadAllowlist(cli.allowlistFile)
+		if err != nil {
+			return fmt.Errorf("--enforce-allowlist: %s", err.Error())
+		}
+		opts.Allowlist = allowed
+	}
+	cli.jobConfigs = map[string]config.Config{}
+	if cli.jobsFile != "" {
+		jobs, err := config.LoadJobs(cli.jobsFile)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			cli.files = append(cli.files, job.Target)
+			cli.jobConfigs[discovery.StateKey(job.Target)] = job.Config
+		}
+	}
+
+	if cli.catalogFile != "" {
+		if err := discovery.LoadCatalog(cli.catalogFile, true); err != nil {
+			return err
+		}
+	} else if err := discovery.LoadCatalog(discovery.DefaultCatalogPath(), false); err != nil {
+		return err
+	}
+	discovery.EditorCatalog = append(discovery.EditorCatalog, discovery.ProductCatalog()...)
+	if cli.discoverCLI {
+		cli.extraDirs = append(cli.extraDirs, discovery.CLIRoots()...)
+	}
+	for _, dirs := range []map[string]string{cfg.ExtensionDirs, cfg.Profiles[cli.profileName].ExtensionDirs, cli.flagDirs} {
+		for editor, dir := range dirs {
+			found := false
+			for _, entry := range discovery.EditorCatalog {
+				found = found || entry.Editor == editor
+			}
+			if !found {
+				return fmt.Errorf("extension directory override for unknown editor %s", editor)
+			}
+			if strings.HasPrefix(dir, "~/") || dir == "~" {
+				dir = discovery.ExpandCatalogDir(discovery.UserHomeDir(), dir)
+			}
+			absDir, err := filepath.Abs(dir)
+			if err != nil {
+				return err
+			}
+			cli.dirOverrides[editor] = absDir
+		}
+	}
+	for _, editor := range cli.editors {
+		known := []string{}
+		found := false
+		for _, entry := range discovery.EditorCatalog {
+			known = append(known, entry.Editor)
+			found = found || entry.Editor == editor
+		}
+		if !found {
+			return fmt.Errorf("unknown editor %s (known editors: %s)", editor, strings.Join(known, ", "))
+		}
+	}
+
+	if cli.specsFile != "" {
+		if err := discovery.LoadSpecs(cli.specsFile, true); err != nil {
+			return err
+		}
+	} else if err := discovery.LoadSpecs(discovery.DefaultSpecsPath(), false); err != nil {
+		return err
+	}
+	cli.install()
+	return nil
+}
+
+func (cli *cliOptions) explainSettings() {
+	opts := cli.opts
+	mode := "patch"
+	for _, flag := range modeFlags {
+		if cli.given[flag] {
+			mode = strings.TrimPrefix(flag, "--")
+		}
+	}
+	ruleStates := []string{}
+	for _, rule := range rules.Known {
+		enabled := opts.RuleEnabled(rule)
+		if rule == "plans" {
+			enabled = enabled && opts.UnlockPlans
+		}
+		ruleStates = append(ruleStates, rule+"="+onOff(enabled))
+	}
+	filterSource := ""
+	orderSource := "newest"
+	if opts.Order.OldestFirst {
+		orderSource = "oldest"
+	} else if opts.Order.Explicit != nil {
+		orderSource = strings.Join(opts.Order.Explicit, ",")
+	}
+	excludeSources := []string{}
+	for _, pattern := range opts.ExcludeModels {
+		excludeSources = append(excludeSources, pattern.Source)
+	}
+	if opts.Filter != nil {
+		filterSource = opts.Filter.Source
+	}
+	overrides := []string{}
+	for editor, dir := range cli.dirOverrides {
+		overrides = append(overrides, editor+"="+dir)
+	}
+	sort.Strings(overrides)
+	sinkNames := []string{}
+	for name := range cli.cfg.Sinks {
+		sinkNames = append(sinkNames, name)
+	}
+	sort.Strings(sinkNames)
+	targetsFrom := strings.Join(cli.files, ", ")
+	if cli.auto {
+		targetsFrom = strings.TrimPrefix(targetsFrom+", --auto", ", ")
+	}
+	explainFlags([][2]string{
+		{"mode", mode},
+		{"targets", targetsFrom},
+		{"home", discovery.UserHomeDir()},
+		{"CODEX_AUTOPATCH_HOME", os.Getenv("CODEX_AUTOPATCH_HOME")},
+		{"environment", strings.Join(cli.envNames, ",")},
+		{"config", cli.cfgPath},
+		{"profile", cli.profileName},
+		{"rules", strings.Join(ruleStates, " ")},
+		{"include_mini", onOff(opts.IncludeMini)},
+		{"auth_only_keep", strings.Join(opts.AuthOnlyKeep, ",")},
+		{"ensure_models", strings.Join(opts.EnsureModels, ",")},
+		{"models", strings.Join(opts.Models, ",")},
+		{"add_models", strings.Join(opts.AddModels, ",")},
+		{"preset", cli.presetName},
+		{"order", orderSource},
+		{"pin_first", strings.Join(opts.PinFirst, ",")},
+		{"exclude_models", strings.Join(excludeSources, " ")},
+		{"filter", filterSource},
+		{"editors", strings.Join(cli.editors, ",")},
+		{"exclude_editors", strings.Join(opts.ExcludeEditors, ",")},
+		{"extension_dirs", strings.Join(overrides, ",")},
+		{"paranoid", onOff(opts.Paranoid)},
+		{"from_backup", onOff(opts.FromBackup)},
+		{"concurrency", strconv.Itoa(cli.concurrency)},
+		{"output", cli.outputMode},
+		{"state", discovery.StatePath()},
+		{"manifest", cli.manifest},
+		{"sinks", strings.Join(sinkNames, ",")},
+		{"temp_dir", tempRoot()},
+		{"backup_dir", cli.backupDir},
+		{"scan", strings.Join(cli.scanDirs, ",")},
+		{"language", cli.language},
+		{"stats_json", cli.statsFile},
+	})
+}
+
+func runRestore(cli *cliOptions) int {
+	defer sinks.Close()
+	if cli.undoLast {
+		return undoRestore(cli.files)
+	}
+	if cli.lastKnownGood {
+		return restoreLastKnownGood(cli.files)
+	}
+	for _, dir := range cli.scanDirs {
+		for _, target := range discovery.ScanTree(dir) {
+			if _, err := os.Stat(discovery.BackupPath(target)); err == nil {
+				cli.files = append(cli.files, discovery.BackupPath(target))
+			}
+		}
+	}
+	return restore(cli.files, cli.restoreTo, cli.force)
+}
+
+func (cli *cliOptions) collectTargets(verbose bool) ([]string, map[string]string, bool) {
+	discovered := []string{}
+	if cli.auto {
+		for _, target := range discovery.DiscoverTargets("bundle") {
+			excluded := false
+			for _, editor := range cli.opts.ExcludeEditors {
+				if editor == target.Editor {
+					excluded = true
+				}
+			}
+			if excluded {
+				if verbose {
+					output.Logf("[skip]    %s (editor %s excluded by config)\n", target.Path, target.Editor)
+				}
+				continue
+			}
+			discovered = append(discovered, target.Path)
+		}
+	}
+	for _, dir := range cli.scanDirs {
+		discovered = append(discovered, discovery.ScanTree(dir)...)
+	}
+	targets, sources := mergeTargets(cli.files, discovered)
+	existing := []string{}
+	for _, target := range targets {
+		resolved, err := discovery.ResolveLink(target)
+		if err != nil {
+			if verbose {
+				output.Logf("[error]   %s\n", err.Error())
+			}
+			continue
+		}
+		if resolved != target {
+			if verbose {
+				output.Logf("[link]    %s -> %s (patching the real file so its backup sits beside it)\n", target, resolved)
+			}
+			sources[discovery.StateKey(resolved)] = sources[discovery.StateKey(target)]
+			target = resolved
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			if verbose {
+				output.Logf("[error]   %s does not exist\n", target)
+			}
+			continue
+		}
+		if !cli.newerThan.IsZero() && !info.ModTime().After(cli.newerThan) {
+			if verbose {
+				output.Logf("[skip]    %s (modified %s, not newer than %s)\n", target, info.ModTime().Format(time.RFC3339), cli.newerThan.Format(time.RFC3339))
+			}
+			continue
+		}
+		existing = append(existing, target)
+		if verbose {
+			sinks.Publish(sinks.EventDiscovered, target, "")
+		}
+	}
+	if verbose && len(targets) == 0 {
+		output.Logln(output.Say("没有找到需要 patch 的文件。请指定文件或使用 --auto。", "No files to patch found. Pass files or use --auto."))
+	}
+	return existing, sources, len(targets) > 0
+}
+
+func runCheck(cli *cliOptions, existing []string) int {
+	findings, compliant := checkTargets(existing, cli.opts)
+	state := sinks.LoadState()
+	for _, target := range existing {
+		for _, model := range deprecatedModels(target, state.Models[discovery.EditorForPath(target)], cli.opts.EnsureModels) {
+			output.Logf("[deprecated] %s no longer advertised upstream (%s)\n", model, target)
+			findings = append(findings, checkFinding{path: target, rule: "deprecated-model", level: "note", message: fmt.Sprintf("%s is no longer advertised upstream", model)})
+		}
+	}
+	if cli.sarifFile != "" {
+		if err := writeSarif(cli.sarifFile, findings); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			return 1
+		}
+		output.Logf("[sarif]   %s\n", cli.sarifFile)
+	}
+	if cli.command == "status" {
+		if state.Counters.LastSuccess != "" {
+			output.Logf("[status]  %d runs, %d patches applied, last clean run %s\n", state.Counters.Runs, state.Counters.Patched, state.Counters.LastSuccess)
+		} else {
+			output.Logln("[status]  no clean run recorded yet")
+		}
+	}
+	if !compliant {
+		return 1
+	}
+	return exitOK
+}
+
+func printArrays(existing []string, opts rules.Options, mode string) int {
+	extracted := []rules.BundleArrays{}
+	for _, target := range existing {
+		content, err := os.ReadFile(target)
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			return 1
+		}
+		text := string(content)
+		sources := rules.BundleSources
+		if mode == "patched" {
+			text, _ = rules.Apply(text, opts)
+			sources = append(append([]rules.ModelSource{}, rules.BundleSources...), rules.OptionSources(opts)...)
+		}
+		arrays := rules.ExtractArrays(target, text)
+		provenance := rules.ModelProvenance(rules.UnpackText(string(content)), sources)
+		arrays.Provenance = map[string][]string{}
+		for _, model := range arrays.Arrays["apikey"] {
+			if labels, ok := provenance[rules.NormalizeName(model)]; ok {
+				arrays.Provenance[model] = labels
+			}
+		}
+		extracted = append(extracted, arrays)
+	}
+	encoded, _ := json.MarshalIndent(extracted, "", "  ")
+	fmt.Println(string(encoded))
+	return exitOK
+}
+
+func runPatchCommand(cli *cliOptions, existing []string, sources map[string]string, interrupts chan os.Signal) int {
+	if cli.plan || cli.approvedPlan != "" {
+		plan, err := buildPlan(existing, cli.opts)
+		if err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			return 1
+		}
+		if cli.plan {
+			encoded, _ := json.MarshalIndent(plan, "", "  ")
+			fmt.Println(string(encoded))
+			return exitOK
+		}
+		if plan.Hash != cli.approvedPlan {
+			output.Logf("[error]   plan hash mismatch: approved %s, current %s\n", cli.approvedPlan, plan.Hash)
+			return 1
+		}
+	}
+	// Bind before the first run so a busy address fails without writing anything.
+	if cli.metricsListen != "" {
+		if err := sinks.ServeMetrics(cli.metricsListen); err != nil {
+			output.Logf("[error]   %s\n", err.Error())
+			return exitListenFailed
+		}
+	}
+
+	mergeModels := map[string][]string{}
+	runFailed := false
+	runPatch := func(existing []string, sources map[string]string) {
+		started := time.Now()
+		if len(sinks.Active) == 0 {
+			if err := sinks.Open(cli.cfg.Sinks); err != nil {
+				output.Logf("[error]   %s\n", err.Error())
+			}
+		}
+		state := sinks.LoadState()
+		trackUpstreamModels(&state, existing)
+		targetOpts := make([]rules.Options, len(existing))
+		for i, target := range existing {
+			targetOpts[i] = cli.opts
+			if job, ok := cli.jobConfigs[discovery.StateKey(target)]; ok {
+				targetOpts[i].Disabled = map[string]bool{}
+				for rule, disabled := range cli.opts.Disabled {
+					targetOpts[i].Disabled[rule] = disabled
+				}
+				job.Apply(&targetOpts[i])
+			}
+			if models, ok := mergeModels[discovery.StateKey(target)]; ok {
+				targetOpts[i].ExtraModels = append(append([]string{}, targetOpts[i].ExtraModels...), models...)
+			}
+			deprecated := deprecatedModels(target, state.Models[discovery.EditorForPath(target)], targetOpts[i].EnsureModels)
+			for _, model := range deprecated {
+				if cli.pruneDeprecated {
+					output.Logf("[deprecated] %s no longer advertised upstream, dropped (%s)\n", model, target)
+				} else {
+					output.Logf("[deprecated] %s no longer advertised upstream, kept; use --prune-deprecated to drop it (%s)\n", model, target)
+				}
+			}
+			if len(deprecated) > 0 && cli.pruneDeprecated {
+				targetOpts[i].DropModels = append(append([]string{}, targetOpts[i].DropModels...), deprecated...)
+			} else if len(deprecated) > 0 {
+				targetOpts[i].ExtraModels = append(append([]string{}, targetOpts[i].ExtraModels...), deprecated...)
+			}
+		}
+		host := sinks.HostName()
+		emit := func(i int, result *sinks.TargetResult) {
+			key := discovery.StateKey(existing[i])
+			previous, seen := state.Targets[key]
+			if seen && previous.Host != "" && previous.Host != host {
+				output.Logf("[note]    ignoring state for %s recorded on %s (%s)\n", key, previous.Host, previous.OS)
+				seen = false
+			}
+			unchanged := result.Result == "compliant" && seen && previous.Result != "failed" && previous.Hash == result.Hash
+			if !cli.changedOnly || !unchanged {
+				os.Stdout.Write(output.FilterLog(result.Out.Bytes()))
+			}
+		}
+		results := patchAll(existing, func(i int) rules.Options { return targetOpts[i] }, cli.concurrency, cli.outputMode == "stream", emit)
+		if cli.opts.DryRun {
+			pending := 0
+			for _, result := range results {
+				if result.Result == "dry-run" {
+					pending++
+				}
+				runFailed = runFailed || result.Result == "failed"
+			}
+			output.Logf(output.Say("试运行完成：%d 个文件将被修改，未写入任何内容。\n", "Dry run finished: %d file(s) would change; nothing was written.\n"), pending)
+			return
+		}
+		patchedEditors := []string{}
+		for i, target := range existing {
+			key := discovery.StateKey(target)
+			if results[i].Result == "patched" {
+				patchedEditors = append(patchedEditors, discovery.EditorForPath(target))
+			}
+			if cli.restoreScripts && results[i].Result != "failed" {
+				if _, err := os.Stat(discovery.BackupPath(target)); err == nil {
+					if script, err := writeRestoreScript(target); err != nil {
+						output.Logf("[error]   %s\n", err.Error())
+					} else {
+						output.Logf("[script]  %s\n", script)
+					}
+				}
+			}
+			if results[i].Result == sinks.EventPatched {
+				sinks.Publish(results[i].Result, target, discovery.BackupPath(target))
+			} else {
+				sinks.Publish(results[i].Result, target, "")
+			}
+			if results[i].Result != "failed" {
+				if content, err := os.ReadFile(target); err == nil {
+					if models := rules.ExtractArrays(target, string(content)).Arrays["apikey"]; len(models) > 0 {
+						state.Models[discovery.EditorForPath(target)] = models
+					}
+				}
+			}
+			backupVersion := state.Targets[key].BackupVersion
+			if info, err := os.Stat(discovery.BackupPath(target)); err == nil {
+				recorded, _ := time.Parse(time.RFC3339, state.Targets[key].UpdatedAt)
+				if backupVersion == "" || info.ModTime().Truncate(time.Second).After(recorded) {
+					backupVersion = discovery.TargetVersion(target)
+				}
+			}
+			state.Targets[key] = sinks.TargetState{
+				Result:        results[i].Result,
+				Hash:          results[i].Hash,
+				UpdatedAt:     time.Now().UTC().Format(time.RFC3339),
+				Host:          host,
+				OS:            runtime.GOOS,
+				Editor:        discovery.EditorForPath(target),
+				Source:        sources[key],
+				BackupVersion: backupVersion,
+				GoodHash:      state.Targets[key].GoodHash,
+				GoodAt:        state.Targets[key].GoodAt,
+				DurationMS:    float64(results[i].Duration.Microseconds()) / 1000,
+			}
+			switch results[i].Result {
+			case "patched":
+				state.Counters.Patched++
+			case "failed":
+				state.Counters.Failed++
+			}
+			if good := state.Targets[key].GoodHash; results[i].Result == "patched" && good != "" && good != results[i].Hash {
+				output.Logf("[note]    %s differs from its last known good content (%s, %s); roll back with --restore --last-known-good\n", target, good[:12], state.Targets[key].GoodAt)
+			}
+		}
+		state.Counters.Runs++
+		failed := false
+		for _, result := range results {
+			failed = failed || result.Result == "failed"
+		}
+		runFailed = runFailed || failed
+		if !failed {
+			state.Counters.LastSuccess = time.Now().UTC().Format(time.RFC3339)
+		}
+		sinks.SaveState(state)
+		if cli.metricsFile != "" {
+			if err := sinks.WriteMetrics(cli.metricsFile, state); err != nil {
+				output.Logf("[error]   %s\n", err.Error())
+			}
+		}
+		sinks.Publish(sinks.EventCompleted, "", "")
+		sinks.Close()
+		if len(cli.jobConfigs) > 0 {
+			counts := map[string]int{}
+			for i, target := range existing {
+				if _, ok := cli.jobConfigs[discovery.StateKey(target)]; ok {
+					counts[results[i].Result]++
+				}
+			}
+			output.Logf(output.Say("[jobs]    %d 个任务：%d 个已 patch，%d 个已合规，%d 个失败。\n", "[jobs]    %d job(s): %d patched, %d compliant, %d failed.\n"), counts["patched"]+counts["compliant"]+counts["failed"], counts["patched"], counts["compliant"], counts["failed"])
+		}
+		if cli.statsFile != "" {
+			if err := sinks.WriteStats(cli.statsFile, sinks.BuildStats(existing, results, time.Since(started))); err != nil {
+				output.Logf("[error]   %s\n", err.Error())
+			}
+		}
+
+		printCompletion(patchedEditors)
+	}
+	if cli.pickTargets && cli.approvedPlan == "" && len(existing) > 1 {
+		if canPrompt() {
+			existing = selectTargets(existing, cli.opts)
+		} else {
+			output.Logln("[note]    --select needs a terminal on stdin; patching every target")
+		}
+	}
+	if !cli.opts.DryRun {
+		existing = resolveConflicts(existing, cli.onConflict, mergeModels)
+	}
+	if !cli.opts.DryRun && !cli.assumeYes && canPrompt() && !confirmPatch(existing, cli.opts) {
+		output.Logln(output.Say("已取消，未修改任何文件。", "Cancelled; no files were changed."))
+		return 1
+	}
+	runPatch(existing, sources)
+
+	if cli.verifyAfter > 0 {
+		time.Sleep(cli.verifyAfter)
+		state := sinks.LoadState()
+		targets, sources, _ := cli.collectTargets(false)
+		raced := []string{}
+		for _, target := range targets {
+			content, err := os.ReadFile(target)
+			if err != nil {
+				continue
+			}
+			if previous, ok := state.Targets[discovery.StateKey(target)]; ok && previous.Hash == discovery.SHA256Hex(content) {
+				continue
+			}
+			output.Logf("[drift]   %s changed within %s of patching (extension update race?); patching again\n", target, cli.verifyAfter)
+			raced = append(raced, target)
+		}
+		if len(raced) == 0 {
+			output.Logf("[ok]      bundles unchanged %s after patching\n", cli.verifyAfter)
+		} else {
+			sinks.CountDrift(len(raced))
+			runPatch(raced, sources)
+		}
+	}
+
+	if runFailed && cli.launch == nil && cli.watchInterval == 0 {
+		return exitPartial
+	}
+
+	if cli.launch != nil {
+		code := launchEditor(cli.launch)
+		if code == exitOK && runFailed {
+			code = exitPartial
+		}
+		return code
+	}
+
+	if cli.watchInterval > 0 {
+		output.Logf("[watch]   polling every %s; press Ctrl+C to stop\n", cli.watchInterval)
+		// Stop between polls instead of exiting from the signal handler, so a run that
+		// failed during the session still sets the exit code.
+		signal.Stop(interrupts)
+		stopSignals := make(chan os.Signal, 1)
+		signal.Notify(stopSignals, os.Interrupt, syscall.SIGTERM)
+		stop := make(chan struct{})
+		go func() {
+			<-stopSignals
+			close(stop)
+		}()
+		watchTargets(cli.watchInterval, existing, func() []string {
+			targets, _, _ := cli.collectTargets(false)
+			return targets
+		}, func(changed []string) {
+			sinks.CountDrift(len(changed))
+			_, sources, _ := cli.collectTargets(false)
+			if changed = resolveConflicts(changed, cli.onConflict, mergeModels); len(changed) > 0 {
+				runPatch(changed, sources)
+			}
+		}, stop)
+		cleanupRunTemp()
+		if runFailed {
+			return exitPartial
+		}
+		return 130
+	}
+	return exitOK
+}
+
+func runConfigCommand(args []string) int {
+	cfgPath := discovery.ConfigPath()
+	if args[0] == "lint" {
+		if len(args) > 2 {
+			output.Logln("[error]   usage: config lint [file]")
+			return exitUsage
+		}
+		if len(args) == 2 {
+			cfgPath = args[1]
+		}
+		return config.Lint(cfgPath)
+	}
+	force := false
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "--force":
+			force = true
+		case !strings.HasPrefix(arg, "-"):
+			cfgPath = arg
+		default:
+			output.Logln("[error]   usage: config init [file] [--force]")
+			return exitUsage
+		}
+	}
+	return config.Init(cfgPath, force)
+}
+
+func run(cli cliOptions) int {
+	cli.install()
+	if cli.schema {
+		return printSchemas(cli.files)
+	}
+	if cli.command == "patch" {
+		for _, legacy := range legacyModeFlags {
+			if cli.given[legacy[0]] {
+				output.Logf("[note]    %s is deprecated and will be removed in the next release; use \"%s\" instead\n", legacy[0], legacy[1])
+			}
+		}
+	}
+	if cli.perMachine {
+		if cli.manifest == "" && !cli.given["--manifest"] {
+			cli.manifest = filepath.Join(discovery.MachineDataDir(), "manifest.jsonl")
+			sinks.SetManifest(cli.manifest)
+		}
+		if err := os.MkdirAll(discovery.MachineDataDir(), 0o755); err != nil {
+			output.Logf("[error]   --per-machine needs write access to %s (run as administrator, SYSTEM or root): %s\n", discovery.MachineDataDir(), err.Error())
+			return 1
+		}
+	}
+	if cli.allUsers && runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		output.Logln("[note]    --all-users without root only reaches the homes and system installs this account can write to")
+	}
+
+	cleanupOrphanTemps()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		cleanupRunTemp()
+		os.Exit(130)
+	}()
+
+	if err := cli.loadSettings(); err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return exitUsage
+	}
+	if cli.niceLevel > 0 || cli.ioIdle {
+		lowerPriority(cli.niceLevel, cli.ioIdle)
+	}
+	if cli.explain {
+		cli.explainSettings()
+	}
+	if cli.restore {
+		return runRestore(&cli)
+	}
+	if cli.upstream {
+		return checkUpstream()
+	}
+
+	existing, sources, found := cli.collectTargets(true)
+	if !found && cli.watchInterval == 0 && cli.launch == nil && cli.command != "doctor" {
+		return exitNoTargets
+	}
+	switch {
+	case cli.markGood:
+		return markGood(existing)
+	case cli.command == "list":
+		listTargets(existing, cli.opts)
+		return exitOK
+	case cli.command == "diff":
+		return diffTargets(existing, cli.opts)
+	case cli.command == "doctor":
+		return doctor(existing, cli.opts)
+	case cli.command == "recover":
+		return recoverTargets(existing, cli.opts)
+	case cli.check:
+		return runCheck(&cli, existing)
+	case cli.printMode != "":
+		return printArrays(existing, cli.opts, cli.printMode)
+	}
+	return runPatchCommand(&cli, existing, sources, interrupts)
+}
+
+// Main runs the command line in args and returns the process exit code.
+func Main(args []string) int {
+	if len(args) >= 2 && args[0] == "config" && (args[1] == "lint" || args[1] == "init") {
+		return runConfigCommand(args[1:])
+	}
+	cli, err := parseArgs(args)
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return exitUsage
+	}
+	return run(cli)
+}
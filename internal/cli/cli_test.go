@@ -0,0 +1,302 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huangang/codex-autopatch/internal/discovery"
+	"github.com/huangang/codex-autopatch/internal/rules"
+	"github.com/huangang/codex-autopatch/internal/sinks"
+)
+
+func TestWriteBundleReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "index-abc.js")
+	if err := os.WriteFile(bundle, []byte("old"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.js")
+	if err := os.Symlink(bundle, link); err != nil {
+		t.Skip("symlinks unavailable:", err)
+	}
+	cleared, err := writeBundle(link, []byte("new content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cleared {
+		t.Errorf("read-only bundle not reported as cleared")
+	}
+	if content, _ := os.ReadFile(bundle); string(content) != "new content" {
+		t.Errorf("bundle holds %q after the write", content)
+	}
+	if info, err := os.Stat(bundle); err != nil || info.Mode().Perm() != 0o444 {
+		t.Errorf("mode not kept: %v %v", info.Mode(), err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink replaced by a regular file")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("temp files left behind: %d entries", len(entries))
+	}
+}
+
+func TestPlanMatchesPatchFromBackup(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CODEX_AUTOPATCH_HOME", home)
+	bundle := filepath.Join(home, "index-abc.js")
+	pristine := `const DEFAULT_MODEL_ORDER=["gpt-5.1-codex-max","gpt-5.1"],M={apikey:["gpt-5"],chatgpt:DEFAULT_MODELS};`
+	edited := pristine + `var handEdited=1;`
+	if err := os.WriteFile(bundle+".bak", []byte(pristine), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundle, []byte(edited), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := rules.Options{Disabled: map[string]bool{}, FromBackup: true}
+	plan, err := buildPlan([]string{bundle}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := patchFile(io.Discard, bundle, opts); status != "patched" {
+		t.Fatalf("status %s, want patched", status)
+	}
+	written, _ := os.ReadFile(bundle)
+	if entry := plan.Entries[0]; entry.PatchedHash != discovery.SHA256Hex(written) || entry.OriginalHash != discovery.SHA256Hex([]byte(edited)) {
+		t.Fatalf("plan %+v does not describe the write from the backup", entry)
+	}
+}
+
+func TestPatchFileIsByteStableAcrossRuns(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CODEX_AUTOPATCH_HOME", home)
+	bundle := filepath.Join(home, "index-abc.js")
+	fixture := `var a=1;const DEFAULT_MODEL_ORDER=["gpt-5.1-codex-max","gpt-5.1-codex","gpt-5.1","gpt-5-codex-mini"],M={apikey:["gpt-5-codex","gpt-5"],chatgpt:DEFAULT_MODELS},P={plus:["gpt-5"],pro:["gpt-5","gpt-5-pro"],team:[]};var CHAT_GPT_AUTH_ONLY_MODELS=new Set(["gpt-5.1-codex-max","gpt-5-pro"]);` + "\n"
+	if err := os.WriteFile(bundle, []byte(fixture), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := rules.Options{Disabled: map[string]bool{}, Compressed: "regenerate", UnlockPlans: true}
+	if status, _, _ := patchFile(io.Discard, bundle, opts); status != "patched" {
+		t.Fatalf("first run: status %s, want patched", status)
+	}
+	first, _ := os.ReadFile(bundle)
+	if len(first) == len(fixture) {
+		t.Fatalf("first run did not change the bundle")
+	}
+	for run := 2; run <= 10; run++ {
+		status, _, _ := patchFile(io.Discard, bundle, opts)
+		if status != "compliant" {
+			t.Fatalf("run %d: status %s, want compliant", run, status)
+		}
+		again, _ := os.ReadFile(bundle)
+		if len(again) != len(first) || string(again) != string(first) {
+			t.Fatalf("run %d: bundle changed from %d to %d bytes", run, len(first), len(again))
+		}
+	}
+	if backup, _ := os.ReadFile(bundle + ".bak"); string(backup) != fixture {
+		t.Fatalf("backup no longer holds the original bundle")
+	}
+}
+
+func TestPatchFileDriftAndDryRunWording(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	bundle := filepath.Join(home, "index-abc.js")
+	fixture := `var a=1;const DEFAULT_MODEL_ORDER=["gpt-5.1-codex-max","gpt-5.1"],M={apikey:["gpt-5"],chatgpt:DEFAULT_MODELS};` + "\n"
+	if err := os.WriteFile(bundle, []byte(fixture), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := rules.Options{Disabled: map[string]bool{}, Compressed: "regenerate", EnsureModels: []string{"gpt-9-codex"}, AddModels: []string{"gpt-9.1-codex"}, DryRun: true}
+	var out strings.Builder
+	status, _, drifted := patchFile(&out, bundle, opts)
+	if status != "dry-run" || !drifted {
+		t.Fatalf("dry run: status %s, drifted %v", status, drifted)
+	}
+	if !strings.Contains(out.String(), "gpt-9-codex was missing from the computed model list and would be added") ||
+		!strings.Contains(out.String(), "gpt-9.1-codex is not referenced by the bundle and would be added") ||
+		strings.Contains(out.String(), "has been added") {
+		t.Fatalf("dry run output claims a write:\n%s", out.String())
+	}
+	if content, _ := os.ReadFile(bundle); string(content) != fixture {
+		t.Fatalf("dry run changed the bundle")
+	}
+
+	opts.DryRun = false
+	if status, _, drifted := patchFile(io.Discard, bundle, opts); status != "patched" || !drifted {
+		t.Fatalf("first run: status %s, drifted %v", status, drifted)
+	}
+	if status, _, drifted := patchFile(io.Discard, bundle, opts); status != "compliant" || drifted {
+		t.Fatalf("second run: status %s, drifted %v", status, drifted)
+	}
+	if status, _, drifted := patchFile(io.Discard, filepath.Join(home, "missing.js"), opts); status != "failed" || drifted {
+		t.Fatalf("unreadable bundle: status %s, drifted %v", status, drifted)
+	}
+	stats := sinks.BuildStats([]string{bundle, bundle}, []sinks.TargetResult{{Result: "patched", Drifted: true}, {Result: "failed"}}, time.Second)
+	if stats.Drifted != 1 || stats.Patched != 1 || stats.Failed != 1 {
+		t.Fatalf("stats %+v, want one drifted bundle", stats)
+	}
+}
+
+func TestWatchTargetsIgnoresOwnWrites(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "index-abc.js")
+	if err := os.WriteFile(bundle, []byte(`M={apikey:["gpt-5"],chatgpt:DEFAULT_MODELS};`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runs := make(chan []string, 10)
+	run := func(changed []string) {
+		// Behave like a patch: back up, then rewrite the bundle several times in a row.
+		original, _ := os.ReadFile(bundle)
+		os.WriteFile(bundle+".bak", original, 0o644)
+		for i := 0; i < 5; i++ {
+			os.WriteFile(bundle, []byte(fmt.Sprintf(`M={apikey:["gpt-5","gpt-5.1"%s],chatgpt:DEFAULT_MODELS};`, strings.Repeat(" ", i))), 0o644)
+		}
+		runs <- changed
+	}
+	collect := func() []string { return []string{bundle, bundle + ".bak"} }
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchTargets(50*time.Millisecond, []string{bundle}, collect, run, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	time.Sleep(250 * time.Millisecond)
+	if len(runs) != 0 {
+		t.Fatalf("run triggered without any change")
+	}
+	// An editor update arrives as a storm of writes; it must settle into a single run.
+	for i := 0; i < 20; i++ {
+		os.WriteFile(bundle, []byte(fmt.Sprintf(`M={apikey:["gpt-5"],chatgpt:DEFAULT_MODELS};//%d`, i)), 0o644)
+	}
+	select {
+	case changed := <-runs:
+		if len(changed) != 1 || changed[0] != bundle {
+			t.Fatalf("run got %v, want only the bundle", changed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("external change never triggered a run")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if len(runs) != 0 {
+		t.Fatalf("the tool's own writes or backup re-triggered run %d more times", len(runs))
+	}
+}
+
+func TestExpandFileArgUnicode(t *testing.T) {
+	root := t.TempDir()
+	dirs := []string{"用户 扩展", "🚀 rocket", "ドキュメント[1]"}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"index-a.js", "index-b.js"} {
+			if err := os.WriteFile(filepath.Join(root, dir, name), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cases := []struct {
+		arg  string
+		want []string
+	}{
+		{filepath.Join(root, "用户 扩展", "index-a.js"), []string{filepath.Join(root, "用户 扩展", "index-a.js")}},
+		{filepath.Join(root, "🚀 rocket", "index-*.js"), []string{filepath.Join(root, "🚀 rocket", "index-a.js"), filepath.Join(root, "🚀 rocket", "index-b.js")}},
+		{filepath.Join(root, "ドキュメント[1]", "index-b.js"), []string{filepath.Join(root, "ドキュメント[1]", "index-b.js")}},
+		{filepath.Join(root, discovery.GlobEscape("ドキュメント[1]"), "index-?.js"), []string{filepath.Join(root, "ドキュメント[1]", "index-a.js"), filepath.Join(root, "ドキュメント[1]", "index-b.js")}},
+	}
+	for _, c := range cases {
+		got, err := expandFileArg(c.arg)
+		if err != nil {
+			t.Errorf("expandFileArg(%q): %s", c.arg, err)
+			continue
+		}
+		if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("expandFileArg(%q) = %q, want %q", c.arg, got, c.want)
+		}
+	}
+	if _, err := expandFileArg(filepath.Join(root, "😀 missing", "*.js")); err == nil {
+		t.Errorf("a pattern that matches nothing should fail")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	cases := []struct {
+		args    []string
+		command string
+		restore bool
+		launch  int
+		err     string
+	}{
+		{args: []string{"--auto"}, command: "patch"},
+		{args: []string{"restore", "--auto"}, command: "restore", restore: true},
+		{args: []string{"status"}, command: "status"},
+		{args: []string{"exec", "--auto", "--", "code", "--wait"}, command: "patch", launch: 2},
+		{args: []string{"exec", "--auto"}, err: "usage: exec"},
+		{args: []string{"--bogus"}, err: "unknown flag --bogus"},
+		{args: []string{"--watch"}, err: "--watch requires"},
+		{args: []string{"--auto", "--select"}, command: "patch"},
+		{args: []string{"--auto", "--lang", "fr"}, err: "--lang requires one of zh, en"},
+		{args: []string{"--auto", "--models", "gpt-5.1-codex", "--ensure-models", "gpt-5"}, err: "--models cannot be combined with --ensure-models"},
+		{args: []string{"--auto", "--select", "--non-interactive"}, err: "--select cannot be combined with --non-interactive"},
+		{args: []string{"restore", "--auto", "--select"}, err: "--select only applies when patching"},
+		{args: []string{"list", "--restore"}, err: "--restore cannot be used with list"},
+		{args: []string{"--changed-only", "--output=stream"}, err: "--changed-only needs --output grouped"},
+	}
+	for _, c := range cases {
+		cli, err := parseArgs(c.args)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("parseArgs(%q) error = %v, want %q", c.args, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArgs(%q): %s", c.args, err)
+			continue
+		}
+		if cli.command != c.command || cli.restore != c.restore || len(cli.launch) != c.launch {
+			t.Errorf("parseArgs(%q) = command %s, restore %v, launch %q", c.args, cli.command, cli.restore, cli.launch)
+		}
+	}
+}
+
+func TestArraysSchemaListsEveryProvenance(t *testing.T) {
+	var schema struct {
+		Items struct {
+			Properties struct {
+				Provenance struct {
+					AdditionalProperties struct {
+						Items struct {
+							Enum []string `json:"enum"`
+						} `json:"items"`
+					} `json:"additionalProperties"`
+				} `json:"provenance"`
+			} `json:"properties"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(outputSchemas["arrays"]), &schema); err != nil {
+		t.Fatal(err)
+	}
+	enum := map[string]bool{}
+	for _, label := range schema.Items.Properties.Provenance.AdditionalProperties.Items.Enum {
+		enum[label] = true
+	}
+	for _, source := range append(append([]rules.ModelSource{}, rules.BundleSources...), rules.OptionSources(rules.Options{})...) {
+		if !enum[source.Name()] {
+			t.Errorf("provenance %s is missing from the arrays schema enum", source.Name())
+		}
+	}
+}
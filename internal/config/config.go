@@ -0,0 +1,1235 @@
+// Package config reads the config file and the settings layered on top of it.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huangang/codex-autopatch/internal/discovery"
+	"github.com/huangang/codex-autopatch/internal/output"
+	"github.com/huangang/codex-autopatch/internal/rules"
+	"github.com/huangang/codex-autopatch/internal/sinks"
+)
+
+func LoadAllowlist(listPath string) (map[string]bool, error) {
+	content, err := os.ReadFile(listPath)
+	if err != nil {
+		return nil, err
+	}
+	allowed := map[string]bool{}
+	for number, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(strings.SplitN(line, "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		hash := strings.ToLower(fields[0])
+		if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(hash) {
+			return nil, fmt.Errorf("%s:%d: expected a sha256 hex digest, found %s", listPath, number+1, fields[0])
+		}
+		allowed[hash] = true
+	}
+	return allowed, nil
+}
+
+var ConflictPolicies = []string{"ask", "keep", "overwrite", "merge"}
+
+func ValidConflictPolicy(policy string) bool {
+	for _, known := range ConflictPolicies {
+		if policy == known {
+			return true
+		}
+	}
+	return false
+}
+
+type ruleConfig struct {
+	enabled *bool
+	keep    []string
+}
+
+type Config struct {
+	rules          map[string]ruleConfig
+	Sinks          map[string]sinks.Config
+	includeMini    *bool
+	excludeEditors []string
+	ensureModels   []string
+	models         []string
+	addModels      []string
+	excludeModels  []rules.ModelPattern
+	order          *rules.ModelOrder
+	pinFirst       []string
+	Preset         string
+	presets        map[string]Config
+	filter         *rules.ModelFilter
+	ExtensionDirs  map[string]string
+	Nice           *int
+	IOIdle         *bool
+	VerifyAfter    time.Duration
+	OnConflict     string
+	ScanDirs       []string
+	BackupDir      string
+	Language       string
+	StatsJSON      string
+	Profiles       map[string]Config
+}
+
+const configTemplate = `# codex-autopatch configuration. Command-line flags override these settings.
+# Uncomment a line to change its default.
+
+# Keep gpt-5.1-codex-mini and other *-mini models in the picker.
+# include_mini = false
+
+# Models that must stay in the apikey list.
+# ensure_models = ["gpt-5.1-codex-max", "gpt-5.1-codex"]
+
+# Filter expression applied to the computed model list (see --filter).
+# filter = "version >= 5.1"
+
+# Named model preset: max-only, codex-family, everything, conservative or a [presets.*] table below.
+# preset = "codex-family"
+
+# Exact model list in this order, replacing the computed list (like --models).
+# models = ["gpt-5.1-codex-max", "gpt-5.1-codex", "gpt-5.1"]
+
+# Model ids to add although the bundle does not mention them (like --add-model).
+# add_models = ["gpt-5.2-codex-max"]
+
+# Globs or /regexes/ of models to drop; a leading ! drops non-matching models (like --exclude-model).
+# exclude_models = ["*-pro"]
+
+# Array order: "newest", "oldest" or an explicit model list (like --order).
+# order = "newest"
+
+# Models moved to the front of the arrays; the UI preselects the first one (like --pin-first).
+# pin_first = ["gpt-5.1-codex-max"]
+
+# Extra directories searched for bundles in addition to the editor defaults (like --scan).
+# scan = ["~/src/extensions"]
+
+# Editors skipped by --auto.
+# exclude_editors = ["cursor"]
+
+# Keep .bak files under this directory instead of next to each bundle (like --backup-dir).
+# backup_dir = "~/.codex-autopatch/backups"
+
+# Language of summary messages: zh or en (like --lang).
+# language = "zh"
+
+# Write per-run statistics as JSON to a file, or "-" for stdout (like --stats-json).
+# stats_json = "-"
+
+# What to do when another tool already changed a bundle: ask, keep, overwrite or merge.
+# on_conflict = "ask"
+
+# Per-editor extension directory overrides.
+# [extension_dirs]
+# vscode = "~/.vscode/extensions"
+
+# User-defined presets accept include_mini, filter, models, add_models, exclude_models,
+# ensure_models, order and pin_first.
+# [presets.team]
+# exclude_models = ["*-mini", "*-pro"]
+# pin_first = ["gpt-5.1-codex-max"]
+
+# Per-rule switches.
+# [rules.plans]
+# enabled = false
+# [rules.auth_only]
+# keep = ["gpt-5.1-codex-max"]
+`
+
+func Init(cfgPath string, force bool) int {
+	if _, err := os.Stat(cfgPath); err == nil && !force {
+		output.Logf("[error]   %s already exists; pass --force to overwrite it\n", cfgPath)
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(cfgPath), 0o755); err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	if err := os.WriteFile(cfgPath, []byte(configTemplate), 0o644); err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	output.Logf("[config]  wrote %s\n", cfgPath)
+	return 0
+}
+
+func parseTOMLValue(raw string) (any, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "true":
+		return true, nil
+	case raw == "false":
+		return false, nil
+	case strings.HasPrefix(raw, "\""):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", raw)
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return nil, fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("unterminated array %s", raw)
+		}
+		items := []any{}
+		for _, part := range splitTOMLArray(raw[1 : len(raw)-1]) {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			item, err := parseTOMLValue(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value %s", raw)
+	}
+	return value, nil
+}
+
+func splitTOMLArray(body string) []string {
+	parts := []string{}
+	depth := 0
+	var quote rune
+	start := 0
+	for i, ch := range body {
+		switch {
+		case quote != 0:
+			if ch == quote && (quote == '\'' || i == 0 || body[i-1] != '\\') {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '[':
+			depth++
+		case ch == ']':
+			depth--
+		case ch == ',' && depth == 0:
+			parts = append(parts, body[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, body[start:])
+}
+
+func stripTOMLComment(line string) string {
+	var quote rune
+	for i, ch := range line {
+		switch {
+		case quote != 0:
+			if ch == quote && (quote == '\'' || i == 0 || line[i-1] != '\\') {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOML(text string) (map[string]any, error) {
+	root := map[string]any{}
+	current := root
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripTOMLComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid table header %s", lineNo, line)
+			}
+			current = root
+			for _, part := range strings.Split(strings.Trim(line, "[]"), ".") {
+				name := strings.TrimSpace(part)
+				if name == "" {
+					return nil, fmt.Errorf("line %d: invalid table header %s", lineNo, line)
+				}
+				next, ok := current[name]
+				if !ok {
+					next = map[string]any{}
+					current[name] = next
+				}
+				table, ok := next.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("line %d: %s is not a table", lineNo, name)
+				}
+				current = table
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), "\"")
+		raw := strings.TrimSpace(line[eq+1:])
+		for strings.HasPrefix(raw, "[") && strings.Count(raw, "[") > strings.Count(raw, "]") && i+1 < len(lines) {
+			i++
+			raw += " " + strings.TrimSpace(stripTOMLComment(lines[i]))
+		}
+		value, err := parseTOMLValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err.Error())
+		}
+		if _, exists := current[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %s", lineNo, key)
+		}
+		current[key] = value
+	}
+	return root, nil
+}
+
+func tomlStrings(value any, name string) ([]string, error) {
+	items, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of strings", name)
+	}
+	result := []string{}
+	for _, item := range items {
+		text, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of strings", name)
+		}
+		result = append(result, text)
+	}
+	return result, nil
+}
+
+func decodeRules(value any, prefix string, cfg *Config) error {
+	table, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%srules must be a table", prefix)
+	}
+	for name, ruleValue := range table {
+		known := false
+		for _, rule := range rules.Known {
+			if rule == name {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown rule %srules.%s (known rules: %s)", prefix, name, strings.Join(rules.Known, ", "))
+		}
+		table, ok := ruleValue.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%srules.%s must be a table", prefix, name)
+		}
+		rule := ruleConfig{}
+		for field, fieldValue := range table {
+			switch {
+			case field == "enabled":
+				enabled, ok := fieldValue.(bool)
+				if !ok {
+					return fmt.Errorf("%srules.%s.enabled must be true or false", prefix, name)
+				}
+				rule.enabled = &enabled
+			case field == "keep" && name == "auth_only":
+				keep, err := tomlStrings(fieldValue, prefix+"rules.auth_only.keep")
+				if err != nil {
+					return err
+				}
+				rule.keep = keep
+			default:
+				return fmt.Errorf("unknown key %srules.%s.%s", prefix, name, field)
+			}
+		}
+		cfg.rules[name] = rule
+	}
+	return nil
+}
+
+func decodeConfig(raw map[string]any, prefix string) (Config, error) {
+	cfg := Config{rules: map[string]ruleConfig{}}
+	for key, value := range raw {
+		switch {
+		case key == "rules":
+			if err := decodeRules(value, prefix, &cfg); err != nil {
+				return cfg, err
+			}
+		case key == "include_mini":
+			includeMini, ok := value.(bool)
+			if !ok {
+				return cfg, fmt.Errorf("%sinclude_mini must be true or false", prefix)
+			}
+			cfg.includeMini = &includeMini
+		case key == "filter":
+			source, ok := value.(string)
+			if !ok {
+				return cfg, fmt.Errorf("%sfilter must be a string", prefix)
+			}
+			filter, err := rules.ParseFilter(source)
+			if err != nil {
+				return cfg, fmt.Errorf("%sfilter: %s", prefix, err.Error())
+			}
+			cfg.filter = filter
+		case key == "ensure_models":
+			models, err := tomlStrings(value, prefix+"ensure_models")
+			if err != nil {
+				return cfg, err
+			}
+			cfg.ensureModels = models
+		case key == "models":
+			models, err := tomlStrings(value, prefix+"models")
+			if err == nil {
+				models, err = rules.ParseModelList(strings.Join(models, ","), prefix+"models")
+			}
+			if err != nil {
+				return cfg, err
+			}
+			cfg.models = models
+		case key == "order":
+			items := []string{}
+			if text, ok := value.(string); ok {
+				items = append(items, text)
+			} else if list, err := tomlStrings(value, prefix+"order"); err == nil {
+				items = list
+			} else {
+				return cfg, fmt.Errorf("%sorder must be \"newest\", \"oldest\" or an array of models", prefix)
+			}
+			order, err := rules.ParseModelOrder(items, prefix+"order")
+			if err != nil {
+				return cfg, err
+			}
+			cfg.order = &order
+		case key == "pin_first":
+			models, err := tomlStrings(value, prefix+"pin_first")
+			if err == nil {
+				models, err = rules.ParseModelList(strings.Join(models, ","), prefix+"pin_first")
+			}
+			if err != nil {
+				return cfg, err
+			}
+			cfg.pinFirst = models
+		case key == "add_models":
+			models, err := tomlStrings(value, prefix+"add_models")
+			if err == nil {
+				models, err = rules.ParseModelList(strings.Join(models, ","), prefix+"add_models")
+			}
+			if err != nil {
+				return cfg, err
+			}
+			cfg.addModels = models
+		case key == "exclude_models":
+			sources, err := tomlStrings(value, prefix+"exclude_models")
+			if err != nil {
+				return cfg, err
+			}
+			cfg.excludeModels = []rules.ModelPattern{}
+			for _, source := range sources {
+				pattern, err := rules.ParseModelPattern(source)
+				if err != nil {
+					return cfg, fmt.Errorf("%sexclude_models: %s", prefix, err.Error())
+				}
+				cfg.excludeModels = append(cfg.excludeModels, pattern)
+			}
+		case key == "exclude_editors":
+			editors, err := tomlStrings(value, prefix+"exclude_editors")
+			if err != nil {
+				return cfg, err
+			}
+			cfg.excludeEditors = editors
+		case key == "sinks" && prefix == "":
+			sinkTables, ok := value.(map[string]any)
+			if !ok {
+				return cfg, fmt.Errorf("sinks must be a table")
+			}
+			cfg.Sinks = map[string]sinks.Config{}
+			for name, sinkValue := range sinkTables {
+				table, ok := sinkValue.(map[string]any)
+				if !ok {
+					return cfg, fmt.Errorf("sinks.%s must be a table", name)
+				}
+				allowed := map[string][]string{"jsonl": {"path"}, "webhook": {"url"}, "syslog": {"path", "tag"}}[name]
+				if allowed == nil {
+					return cfg, fmt.Errorf("unknown sink sinks.%s (known sinks: jsonl, webhook, syslog)", name)
+				}
+				fields := map[string]string{}
+				for field, fieldValue := range table {
+					known := false
+					for _, candidate := range allowed {
+						if candidate == field {
+							known = true
+						}
+					}
+					text, ok := fieldValue.(string)
+					if !known || !ok {
+						return cfg, fmt.Errorf("unknown key or non-string value sinks.%s.%s", name, field)
+					}
+					fields[field] = text
+				}
+				if name == "jsonl" && fields["path"] == "" {
+					return cfg, fmt.Errorf("sinks.jsonl.path is required")
+				}
+				if name == "webhook" && fields["url"] == "" {
+					return cfg, fmt.Errorf("sinks.webhook.url is required")
+				}
+				cfg.Sinks[name] = sinks.Config{Path: fields["path"], URL: fields["url"], Tag: fields["tag"]}
+			}
+		case key == "nice" && prefix == "":
+			level, ok := value.(int64)
+			if !ok || level < 0 || level > 19 {
+				return cfg, fmt.Errorf("nice must be an integer from 0 to 19")
+			}
+			nice := int(level)
+			cfg.Nice = &nice
+		case key == "verify_after" && prefix == "":
+			text, ok := value.(string)
+			delay, err := time.ParseDuration(text)
+			if !ok || err != nil || delay <= 0 {
+				return cfg, fmt.Errorf("verify_after must be a delay like \"30s\"")
+			}
+			cfg.VerifyAfter = delay
+		case key == "on_conflict" && prefix == "":
+			policy, ok := value.(string)
+			if !ok || !ValidConflictPolicy(policy) {
+				return cfg, fmt.Errorf("on_conflict must be one of %s", strings.Join(ConflictPolicies, ", "))
+			}
+			cfg.OnConflict = policy
+		case key == "scan" && prefix == "":
+			dirs, err := tomlStrings(value, "scan")
+			if err != nil {
+				return cfg, err
+			}
+			cfg.ScanDirs = dirs
+		case key == "backup_dir" && prefix == "":
+			dir, ok := value.(string)
+			if !ok || dir == "" {
+				return cfg, fmt.Errorf("backup_dir must be a directory path")
+			}
+			cfg.BackupDir = dir
+		case key == "language" && prefix == "":
+			lang, ok := value.(string)
+			if !ok || !output.ValidLanguage(lang) {
+				return cfg, fmt.Errorf("language must be one of %s", strings.Join(output.Languages, ", "))
+			}
+			cfg.Language = lang
+		case key == "stats_json" && prefix == "":
+			target, ok := value.(string)
+			if !ok || target == "" {
+				return cfg, fmt.Errorf("stats_json must be a file path or \"-\"")
+			}
+			cfg.StatsJSON = target
+		case key == "io_idle" && prefix == "":
+			ioIdle, ok := value.(bool)
+			if !ok {
+				return cfg, fmt.Errorf("io_idle must be true or false")
+			}
+			cfg.IOIdle = &ioIdle
+		case key == "extension_dirs" && !strings.HasPrefix(prefix, "jobs["):
+			dirs, ok := value.(map[string]any)
+			if !ok {
+				return cfg, fmt.Errorf("extension_dirs must be a table of editor id = directory")
+			}
+			cfg.ExtensionDirs = map[string]string{}
+			for editor, dirValue := range dirs {
+				dir, ok := dirValue.(string)
+				if !ok || dir == "" {
+					return cfg, fmt.Errorf("extension_dirs.%s must be a directory path", editor)
+				}
+				cfg.ExtensionDirs[editor] = dir
+			}
+		case key == "preset" && (prefix == "" || strings.HasPrefix(prefix, "profiles.")):
+			name, ok := value.(string)
+			if !ok || name == "" {
+				return cfg, fmt.Errorf("%spreset must be a preset name", prefix)
+			}
+			cfg.Preset = name
+		case key == "presets" && prefix == "":
+			presets, ok := value.(map[string]any)
+			if !ok {
+				return cfg, fmt.Errorf("presets must be a table")
+			}
+			cfg.presets = map[string]Config{}
+			for name, presetValue := range presets {
+				preset, err := decodePreset(presetValue, "presets."+name+".")
+				if err != nil {
+					return cfg, err
+				}
+				cfg.presets[name] = preset
+			}
+		case key == "profiles" && prefix == "":
+			profiles, ok := value.(map[string]any)
+			if !ok {
+				return cfg, fmt.Errorf("profiles must be a table")
+			}
+			cfg.Profiles = map[string]Config{}
+			for name, profileValue := range profiles {
+				table, ok := profileValue.(map[string]any)
+				if !ok {
+					return cfg, fmt.Errorf("profiles.%s must be a table", name)
+				}
+				profile, err := decodeConfig(table, "profiles."+name+".")
+				if err != nil {
+					return cfg, err
+				}
+				cfg.Profiles[name] = profile
+			}
+		default:
+			return cfg, fmt.Errorf("unknown key %s%s", prefix, key)
+		}
+	}
+	return cfg, nil
+}
+
+var presetKeys = []string{"include_mini", "filter", "models", "add_models", "exclude_models", "ensure_models", "order", "pin_first"}
+
+func decodePreset(value any, prefix string) (Config, error) {
+	table, ok := value.(map[string]any)
+	if !ok {
+		return Config{}, fmt.Errorf("%s must be a table", strings.TrimSuffix(prefix, "."))
+	}
+	for key := range table {
+		known := false
+		for _, candidate := range presetKeys {
+			known = known || key == candidate
+		}
+		if !known {
+			return Config{}, fmt.Errorf("unknown key %s%s (presets accept %s)", prefix, key, strings.Join(presetKeys, ", "))
+		}
+	}
+	return decodeConfig(table, prefix)
+}
+
+const builtinPresetSource = `
+[max-only]
+exclude_models = ["!*codex-max*"]
+
+[codex-family]
+include_mini = true
+exclude_models = ["!*codex*"]
+
+[everything]
+include_mini = true
+
+[conservative]
+exclude_models = ["*-pro", "/(preview|experimental|exp)/"]
+order = "newest"
+`
+
+var builtinPresets, builtinPresetsErr = parseBuiltinPresets()
+
+func parseBuiltinPresets() (map[string]Config, error) {
+	raw, err := parseTOML(builtinPresetSource)
+	if err != nil {
+		return nil, fmt.Errorf("built-in presets: %s", err.Error())
+	}
+	presets := map[string]Config{}
+	for name, value := range raw {
+		preset, err := decodePreset(value, "presets."+name+".")
+		if err != nil {
+			return nil, fmt.Errorf("built-in presets: %s", err.Error())
+		}
+		presets[name] = preset
+	}
+	return presets, nil
+}
+
+func (cfg Config) LookupPreset(name string) (Config, error) {
+	if preset, ok := cfg.presets[name]; ok {
+		return preset, nil
+	}
+	if builtinPresetsErr != nil {
+		return Config{}, builtinPresetsErr
+	}
+	if preset, ok := builtinPresets[name]; ok {
+		return preset, nil
+	}
+	names := []string{}
+	for known := range builtinPresets {
+		names = append(names, known)
+	}
+	for known := range cfg.presets {
+		names = append(names, known)
+	}
+	sort.Strings(names)
+	return Config{}, fmt.Errorf("unknown preset %s (known presets: %s)", name, strings.Join(names, ", "))
+}
+
+type patchJob struct {
+	Target string
+	Config Config
+}
+
+func LoadJobs(path string) ([]patchJob, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []map[string]any{}
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "[") {
+		if err := json.Unmarshal(content, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	} else {
+		parsed, err := parseYAML(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		items, ok := parsed.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a list of jobs", path)
+		}
+		for i, item := range items {
+			entry, ok := item.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: jobs[%d] must be a mapping", path, i)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	jobs := []patchJob{}
+	for i, entry := range entries {
+		target, ok := entry["target"].(string)
+		if !ok || target == "" {
+			return nil, fmt.Errorf("%s: jobs[%d] needs a \"target\" path", path, i)
+		}
+		delete(entry, "target")
+		cfg, err := decodeConfig(entry, fmt.Sprintf("jobs[%d].", i))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		if cfg.excludeEditors != nil {
+			return nil, fmt.Errorf("%s: jobs[%d].exclude_editors has no meaning for a single target", path, i)
+		}
+		jobs = append(jobs, patchJob{Target: target, Config: cfg})
+	}
+	return jobs, nil
+}
+
+type yamlLine struct {
+	indent int
+	text   string
+	lineNo int
+}
+
+// parseYAML reads the small YAML subset a jobs file needs: block sequences and
+// mappings nested by indentation, flow lists, quoted or plain strings, booleans
+// and integers. Anchors, multi-line strings and flow mappings are not supported.
+func parseYAML(text string) (any, error) {
+	lines := []yamlLine{}
+	for i, raw := range strings.Split(text, "\n") {
+		line := strings.TrimRight(stripTOMLComment(raw), " \t\r")
+		body := strings.TrimLeft(line, " ")
+		if body == "" || body == "---" {
+			continue
+		}
+		if strings.HasPrefix(body, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{indent: len(line) - len(body), text: body, lineNo: i + 1})
+	}
+	if len(lines) == 0 {
+		return []any{}, nil
+	}
+	pos := 0
+	value, err := parseYAMLBlock(lines, &pos, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if pos < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[pos].lineNo)
+	}
+	return value, nil
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func parseYAMLBlock(lines []yamlLine, pos *int, indent int) (any, error) {
+	if isYAMLSequenceItem(lines[*pos].text) {
+		return parseYAMLSequence(lines, pos, indent)
+	}
+	return parseYAMLMapping(lines, pos, indent)
+}
+
+func parseYAMLSequence(lines []yamlLine, pos *int, indent int) (any, error) {
+	items := []any{}
+	for *pos < len(lines) && lines[*pos].indent == indent && isYAMLSequenceItem(lines[*pos].text) {
+		line := lines[*pos]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			*pos++
+			if *pos >= len(lines) || lines[*pos].indent <= indent {
+				return nil, fmt.Errorf("line %d: empty list item", line.lineNo)
+			}
+			item, err := parseYAMLBlock(lines, pos, lines[*pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok || isYAMLSequenceItem(rest) {
+			// "- key: value" opens a nested block at the column of "key".
+			lines[*pos] = yamlLine{indent: line.indent + len(line.text) - len(rest), text: rest, lineNo: line.lineNo}
+			item, err := parseYAMLBlock(lines, pos, lines[*pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		item, err := parseYAMLScalar(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line.lineNo, err.Error())
+		}
+		items = append(items, item)
+		*pos++
+	}
+	return items, nil
+}
+
+func parseYAMLMapping(lines []yamlLine, pos *int, indent int) (any, error) {
+	table := map[string]any{}
+	for *pos < len(lines) && lines[*pos].indent == indent && !isYAMLSequenceItem(lines[*pos].text) {
+		line := lines[*pos]
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line.lineNo)
+		}
+		if _, exists := table[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %s", line.lineNo, key)
+		}
+		*pos++
+		if rest != "" {
+			value, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line.lineNo, err.Error())
+			}
+			table[key] = value
+			continue
+		}
+		// A nested block is indented further, except that a list may sit at
+		// the same column as its key.
+		if *pos >= len(lines) || lines[*pos].indent < indent ||
+			(lines[*pos].indent == indent && !isYAMLSequenceItem(lines[*pos].text)) {
+			return nil, fmt.Errorf("line %d: %s has no value", line.lineNo, key)
+		}
+		value, err := parseYAMLBlock(lines, pos, lines[*pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		table[key] = value
+	}
+	if *pos < len(lines) && lines[*pos].indent > indent {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[*pos].lineNo)
+	}
+	return table, nil
+}
+
+func splitYAMLKey(text string) (string, string, bool) {
+	var quote rune
+	for i, ch := range text {
+		switch {
+		case quote != 0:
+			if ch == quote && (quote == '\'' || text[i-1] != '\\') {
+				quote = 0
+			}
+		case (ch == '"' || ch == '\'') && i == 0:
+			quote = ch
+		case ch == '[' && i == 0:
+			return "", "", false
+		case ch == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			key := strings.TrimSpace(text[:i])
+			if strings.HasPrefix(key, "\"") || strings.HasPrefix(key, "'") {
+				unquoted, err := parseYAMLScalar(key)
+				if err != nil {
+					return "", "", false
+				}
+				key, _ = unquoted.(string)
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+func parseYAMLScalar(raw string) (any, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "true" || raw == "false" || strings.HasPrefix(raw, "\""):
+		return parseTOMLValue(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return nil, fmt.Errorf("invalid string %s", raw)
+		}
+		return strings.ReplaceAll(raw[1:len(raw)-1], "''", "'"), nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("unterminated list %s", raw)
+		}
+		items := []any{}
+		for _, part := range splitTOMLArray(raw[1 : len(raw)-1]) {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			item, err := parseYAMLScalar(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case strings.HasPrefix(raw, "{"):
+		return nil, fmt.Errorf("flow mappings are not supported: %s", raw)
+	}
+	if value, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return value, nil
+	}
+	return raw, nil
+}
+
+func (cfg Config) Profile(name string) (Config, error) {
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		names := []string{}
+		for known := range cfg.Profiles {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return Config{}, fmt.Errorf("profile %s not found: the config defines no [profiles.*] tables", name)
+		}
+		return Config{}, fmt.Errorf("profile %s not found (known profiles: %s)", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+func Load(path string, required bool) (Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !required && os.IsNotExist(err) {
+			return Config{rules: map[string]ruleConfig{}}, nil
+		}
+		return Config{}, err
+	}
+	raw, err := parseTOML(string(content))
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	cfg, err := decodeConfig(raw, "")
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+var envSettings = []struct {
+	name string
+	key  string
+	kind string
+}{
+	{"CODEX_AUTOPATCH_ROOTS", "scan", "list"},
+	{"CODEX_AUTOPATCH_INCLUDE_MINI", "include_mini", "bool"},
+	{"CODEX_AUTOPATCH_BACKUP_DIR", "backup_dir", "string"},
+	{"CODEX_AUTOPATCH_LANGUAGE", "language", "string"},
+	{"CODEX_AUTOPATCH_ENSURE_MODELS", "ensure_models", "csv"},
+	{"CODEX_AUTOPATCH_MODELS", "models", "csv"},
+	{"CODEX_AUTOPATCH_EXCLUDE_MODELS", "exclude_models", "csv"},
+	{"CODEX_AUTOPATCH_ADD_MODELS", "add_models", "csv"},
+	{"CODEX_AUTOPATCH_ORDER", "order", "csv"},
+	{"CODEX_AUTOPATCH_PIN_FIRST", "pin_first", "csv"},
+	{"CODEX_AUTOPATCH_PRESET", "preset", "string"},
+	{"CODEX_AUTOPATCH_EXCLUDE_EDITORS", "exclude_editors", "csv"},
+	{"CODEX_AUTOPATCH_FILTER", "filter", "string"},
+	{"CODEX_AUTOPATCH_ON_CONFLICT", "on_conflict", "string"},
+	{"CODEX_AUTOPATCH_VERIFY_AFTER", "verify_after", "string"},
+	{"CODEX_AUTOPATCH_NICE", "nice", "int"},
+	{"CODEX_AUTOPATCH_IO_IDLE", "io_idle", "bool"},
+	{"CODEX_AUTOPATCH_STATS_JSON", "stats_json", "string"},
+}
+
+func EnvBool(name string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(name))) {
+	case "", "0", "false", "no", "off":
+		return false, nil
+	case "1", "true", "yes", "on":
+		return true, nil
+	}
+	return false, fmt.Errorf("%s must be 1/true/yes or 0/false/no, got %q", name, os.Getenv(name))
+}
+
+func FromEnv() (Config, []string, error) {
+	cfg := Config{rules: map[string]ruleConfig{}}
+	names := []string{}
+	for _, setting := range envSettings {
+		text := os.Getenv(setting.name)
+		if text == "" {
+			continue
+		}
+		var value any = text
+		switch setting.kind {
+		case "bool":
+			enabled, err := EnvBool(setting.name)
+			if err != nil {
+				return cfg, nil, err
+			}
+			value = enabled
+		case "int":
+			number, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+			if err != nil {
+				return cfg, nil, fmt.Errorf("%s must be an integer, got %q", setting.name, text)
+			}
+			value = number
+		case "list", "csv":
+			separator := ","
+			if setting.kind == "list" {
+				separator = string(os.PathListSeparator)
+			}
+			items := []any{}
+			for _, item := range strings.Split(text, separator) {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			value = items
+		}
+		decoded, err := decodeConfig(map[string]any{setting.key: value}, "")
+		if err != nil {
+			return cfg, nil, fmt.Errorf("%s: %s", setting.name, err.Error())
+		}
+		cfg = cfg.Merge(decoded)
+		names = append(names, setting.name)
+	}
+	return cfg, names, nil
+}
+
+func (cfg Config) Merge(over Config) Config {
+	for name, rule := range over.rules {
+		cfg.rules[name] = rule
+	}
+	if over.includeMini != nil {
+		cfg.includeMini = over.includeMini
+	}
+	if over.excludeEditors != nil {
+		cfg.excludeEditors = over.excludeEditors
+	}
+	if over.ensureModels != nil {
+		cfg.ensureModels = over.ensureModels
+	}
+	if over.models != nil {
+		cfg.models = over.models
+	}
+	if over.excludeModels != nil {
+		cfg.excludeModels = over.excludeModels
+	}
+	if over.addModels != nil {
+		cfg.addModels = over.addModels
+	}
+	if over.order != nil {
+		cfg.order = over.order
+	}
+	if over.pinFirst != nil {
+		cfg.pinFirst = over.pinFirst
+	}
+	if over.Preset != "" {
+		cfg.Preset = over.Preset
+	}
+	if over.filter != nil {
+		cfg.filter = over.filter
+	}
+	if over.Nice != nil {
+		cfg.Nice = over.Nice
+	}
+	if over.IOIdle != nil {
+		cfg.IOIdle = over.IOIdle
+	}
+	if over.VerifyAfter != 0 {
+		cfg.VerifyAfter = over.VerifyAfter
+	}
+	if over.OnConflict != "" {
+		cfg.OnConflict = over.OnConflict
+	}
+	if over.ScanDirs != nil {
+		cfg.ScanDirs = over.ScanDirs
+	}
+	if over.BackupDir != "" {
+		cfg.BackupDir = over.BackupDir
+	}
+	if over.Language != "" {
+		cfg.Language = over.Language
+	}
+	if over.StatsJSON != "" {
+		cfg.StatsJSON = over.StatsJSON
+	}
+	return cfg
+}
+
+func (cfg Config) Apply(opts *rules.Options) {
+	for name, rule := range cfg.rules {
+		if rule.enabled != nil {
+			opts.Disabled[name] = !*rule.enabled
+			if name == "plans" {
+				opts.UnlockPlans = *rule.enabled
+			}
+		}
+		if name == "auth_only" && rule.keep != nil {
+			opts.AuthOnlyKeep = rule.keep
+		}
+	}
+	if cfg.includeMini != nil {
+		opts.IncludeMini = *cfg.includeMini
+	}
+	if cfg.excludeEditors != nil {
+		opts.ExcludeEditors = cfg.excludeEditors
+	}
+	if cfg.ensureModels != nil {
+		opts.EnsureModels = cfg.ensureModels
+	}
+	if cfg.models != nil {
+		opts.Models = cfg.models
+	}
+	if cfg.excludeModels != nil {
+		opts.ExcludeModels = cfg.excludeModels
+	}
+	if cfg.addModels != nil {
+		opts.AddModels = cfg.addModels
+	}
+	if cfg.order != nil {
+		opts.Order = *cfg.order
+	}
+	if cfg.pinFirst != nil {
+		opts.PinFirst = cfg.pinFirst
+	}
+	if cfg.filter != nil {
+		opts.Filter = cfg.filter
+	}
+}
+
+func ApplyLayers(opts *rules.Options, preset Config, cliPreset bool, layers ...Config) {
+	if !cliPreset {
+		preset.Apply(opts)
+	}
+	for _, layer := range layers {
+		layer.Apply(opts)
+	}
+	if cliPreset {
+		preset.Apply(opts)
+	}
+}
+
+func lintConfigTable(cfg Config, prefix string) []string {
+	problems := []string{}
+	if rule, ok := cfg.rules["auth_only"]; ok && rule.enabled != nil && !*rule.enabled && rule.keep != nil {
+		problems = append(problems, prefix+"rules.auth_only.keep has no effect while rules.auth_only.enabled = false")
+	}
+	if cfg.includeMini != nil && !*cfg.includeMini {
+		for _, model := range cfg.ensureModels {
+			if strings.Contains(strings.ToLower(model), "mini") {
+				problems = append(problems, fmt.Sprintf("%sensure_models keeps %s although include_mini = false", prefix, model))
+			}
+		}
+	}
+	if cfg.models != nil {
+		for _, shaping := range []struct {
+			key string
+			set bool
+		}{{"include_mini", cfg.includeMini != nil}, {"filter", cfg.filter != nil}, {"ensure_models", cfg.ensureModels != nil}, {"exclude_models", cfg.excludeModels != nil}, {"add_models", cfg.addModels != nil}, {"order", cfg.order != nil}, {"pin_first", cfg.pinFirst != nil}} {
+			if shaping.set {
+				problems = append(problems, fmt.Sprintf("%s%s has no effect while %smodels lists the models explicitly", prefix, shaping.key, prefix))
+			}
+		}
+	}
+	for _, editor := range cfg.excludeEditors {
+		known := false
+		for _, entry := range discovery.EditorCatalog {
+			if entry.Editor == editor {
+				known = true
+			}
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("%sexclude_editors names unknown editor %s", prefix, editor))
+		}
+	}
+	return problems
+}
+
+func Lint(cfgPath string) int {
+	cfg, err := Load(cfgPath, true)
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	if err := discovery.LoadCatalog(discovery.DefaultCatalogPath(), false); err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return 1
+	}
+	problems := lintConfigTable(cfg, "")
+	names := []string{}
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, lintConfigTable(cfg.Profiles[name], "profiles."+name+".")...)
+		if preset := cfg.Profiles[name].Preset; preset != "" {
+			if _, err := cfg.LookupPreset(preset); err != nil {
+				problems = append(problems, fmt.Sprintf("profiles.%s.preset: %s", name, err.Error()))
+			}
+		}
+	}
+	if cfg.Preset != "" {
+		if _, err := cfg.LookupPreset(cfg.Preset); err != nil {
+			problems = append(problems, "preset: "+err.Error())
+		}
+	}
+	presetNames := []string{}
+	for name := range cfg.presets {
+		presetNames = append(presetNames, name)
+	}
+	sort.Strings(presetNames)
+	for _, name := range presetNames {
+		problems = append(problems, lintConfigTable(cfg.presets[name], "presets."+name+".")...)
+	}
+	if sink, ok := cfg.Sinks["jsonl"]; ok {
+		target := sink.Path
+		if strings.HasPrefix(target, "~/") {
+			target = discovery.HomePath(target[2:])
+		}
+		if _, err := os.Stat(filepath.Dir(target)); err != nil {
+			problems = append(problems, fmt.Sprintf("sinks.jsonl.path directory %s does not exist", filepath.Dir(target)))
+		}
+	}
+	if sink, ok := cfg.Sinks["syslog"]; ok && sink.Path != "" {
+		if _, err := os.Stat(sink.Path); err != nil {
+			problems = append(problems, fmt.Sprintf("sinks.syslog.path %s does not exist", sink.Path))
+		}
+	}
+	if sink, ok := cfg.Sinks["webhook"]; ok {
+		if parsed, err := url.Parse(sink.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			problems = append(problems, fmt.Sprintf("sinks.webhook.url %s is not an http(s) URL", sink.URL))
+		}
+	}
+	for _, problem := range problems {
+		output.Logf("[lint]    %s: %s\n", cfgPath, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	output.Logf("[ok]      %s\n", cfgPath)
+	return 0
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/huangang/codex-autopatch/internal/rules"
+)
+
+func TestLoadJobsYAML(t *testing.T) {
+	dir := t.TempDir()
+	yamlJobs := `# two installs, two treatments
+- target: /opt/a/extension.js
+  include_mini: true
+  ensure_models: [gpt-5.1-codex-max, "gpt-5.1-codex"]
+  rules:
+    plans:
+      enabled: false
+- target: '/opt/b/extension.js'
+  ensure_models:
+  - gpt-5.1-codex-mini
+`
+	jsonJobs := `[{"target": "/opt/a/extension.js", "include_mini": true, "ensure_models": ["gpt-5.1-codex-max", "gpt-5.1-codex"], "rules": {"plans": {"enabled": false}}},
+ {"target": "/opt/b/extension.js", "ensure_models": ["gpt-5.1-codex-mini"]}]`
+	for name, text := range map[string]string{"jobs.yaml": yamlJobs, "jobs.json": jsonJobs} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := LoadJobs(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(jobs) != 2 || jobs[0].Target != "/opt/a/extension.js" || jobs[1].Target != "/opt/b/extension.js" {
+			t.Fatalf("%s: jobs = %+v", name, jobs)
+		}
+		first, second := jobs[0].Config, jobs[1].Config
+		if first.includeMini == nil || !*first.includeMini || strings.Join(first.ensureModels, ",") != "gpt-5.1-codex-max,gpt-5.1-codex" {
+			t.Errorf("%s: first job config %+v", name, first)
+		}
+		if rule := first.rules["plans"]; rule.enabled == nil || *rule.enabled {
+			t.Errorf("%s: plans rule %+v, want disabled", name, rule)
+		}
+		if strings.Join(second.ensureModels, ",") != "gpt-5.1-codex-mini" {
+			t.Errorf("%s: second job config %+v", name, second)
+		}
+	}
+
+	for _, bad := range []string{"target: /opt/a\n", "- target: /opt/a\n   models: [x]\n", "- target: /opt/a\n  rules:\n"} {
+		path := filepath.Join(dir, "bad.yaml")
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadJobs(path); err == nil {
+			t.Errorf("loadJobs accepted %q", bad)
+		}
+	}
+}
+
+func TestBuiltinPresetsParse(t *testing.T) {
+	if builtinPresetsErr != nil {
+		t.Fatal(builtinPresetsErr)
+	}
+	for _, name := range []string{"max-only", "codex-family", "everything", "conservative"} {
+		if _, err := (Config{}).LookupPreset(name); err != nil {
+			t.Errorf("lookupPreset(%s): %s", name, err)
+		}
+	}
+	if _, err := (Config{}).LookupPreset("no-such-preset"); err == nil {
+		t.Errorf("unknown preset accepted")
+	}
+}
+
+func TestPresetPrecedence(t *testing.T) {
+	preset, _ := (Config{}).LookupPreset("max-only")
+	raw, err := parseTOML("exclude_models = [\"*-pro\"]\ninclude_mini = true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := decodeConfig(raw, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns := func(opts rules.Options) string {
+		names := []string{}
+		for _, pattern := range opts.ExcludeModels {
+			names = append(names, pattern.Source)
+		}
+		return strings.Join(names, ",")
+	}
+
+	layered := rules.Options{Disabled: map[string]bool{}}
+	ApplyLayers(&layered, preset, false, cfg, Config{}, Config{})
+	if got := patterns(layered); got != "*-pro" {
+		t.Errorf("config preset: exclude_models = %s, want the config value *-pro", got)
+	}
+
+	explicit := rules.Options{Disabled: map[string]bool{}}
+	ApplyLayers(&explicit, preset, true, cfg, Config{}, Config{})
+	if got := patterns(explicit); got != "!*codex-max*" {
+		t.Errorf("--preset: exclude_models = %s, want the preset value !*codex-max*", got)
+	}
+	if !explicit.IncludeMini {
+		t.Errorf("--preset dropped include_mini from the config although the preset does not set it")
+	}
+}
@@ -0,0 +1,1147 @@
+// Package discovery finds installed Codex bundles and owns the data, state and
+// backup paths of the tool.
+package discovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"github.com/huangang/codex-autopatch/internal/output"
+	"github.com/huangang/codex-autopatch/internal/rules"
+)
+
+func EditorForPath(filePath string) string {
+	absPath := StateKey(filePath)
+	for _, root := range Roots() {
+		if strings.HasPrefix(absPath, root.Path+string(filepath.Separator)) {
+			return root.Editor
+		}
+	}
+	return ""
+}
+
+func ExtensionDirFor(target string) string {
+	dir := filepath.Dir(target)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "package.json")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func StatePath() string {
+	return DataPath("state.json")
+}
+
+func StateKey(filePath string) string {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return filePath
+	}
+	return absPath
+}
+
+func SHA256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type catalogEntry struct {
+	Editor   string   `json:"editor"`
+	Name     string   `json:"name,omitempty"`
+	Dirs     []string `json:"dirs"`
+	OS       []string `json:"os,omitempty"`
+	Remote   bool     `json:"remote,omitempty"`
+	UserData string   `json:"user_data,omitempty"`
+}
+
+type Root struct {
+	Editor   string
+	Path     string
+	UserData string
+}
+
+func userDataDir(base, name string) string {
+	if name == "" {
+		return ""
+	}
+	if strings.HasPrefix(name, "~/") {
+		return ExpandCatalogDir(base, name)
+	}
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(base, "AppData", "Roaming", name)
+	case "darwin":
+		return filepath.Join(base, "Library", "Application Support", name)
+	default:
+		return filepath.Join(base, ".config", name)
+	}
+}
+
+var EditorCatalog = []catalogEntry{
+	{Editor: "vscode", Name: "VS Code", Dirs: []string{".vscode/extensions"}, UserData: "Code"},
+	{Editor: "vscode-insiders", Name: "VS Code Insiders", Dirs: []string{".vscode-insiders/extensions"}, UserData: "Code - Insiders"},
+	{Editor: "vscodium", Name: "VSCodium", Dirs: []string{".vscode-oss/extensions"}, UserData: "VSCodium"},
+	{Editor: "cursor", Name: "Cursor", Dirs: []string{".cursor/extensions"}, UserData: "Cursor"},
+	{Editor: "windsurf", Name: "Windsurf", Dirs: []string{".windsurf/extensions"}, UserData: "Windsurf"},
+	{Editor: "trae", Name: "Trae", Dirs: []string{".trae/extensions"}, UserData: "Trae"},
+	{Editor: "kiro", Name: "Kiro", Dirs: []string{".kiro/extensions"}, UserData: "Kiro"},
+	{Editor: "vscode-flatpak", Name: "VS Code (Flatpak)", Dirs: []string{".var/app/com.visualstudio.code/data/vscode/extensions"}, OS: []string{"linux"}, UserData: "~/.var/app/com.visualstudio.code/config/Code"},
+	{Editor: "vscode-snap", Name: "VS Code (Snap)", Dirs: []string{"snap/code/current/.vscode/extensions"}, OS: []string{"linux"}},
+	{Editor: "vscodium-flatpak", Name: "VSCodium (Flatpak)", Dirs: []string{".var/app/com.vscodium.codium/data/codium/extensions"}, OS: []string{"linux"}, UserData: "~/.var/app/com.vscodium.codium/config/VSCodium"},
+	{Editor: "vscodium-snap", Name: "VSCodium (Snap)", Dirs: []string{"snap/codium/current/.vscode-oss/extensions"}, OS: []string{"linux"}},
+	{Editor: "code-server", Name: "code-server", Dirs: []string{".local/share/code-server/extensions"}, Remote: true},
+	{Editor: "openvscode-server", Name: "OpenVSCode Server", Dirs: []string{".openvscode-server/extensions"}, Remote: true},
+	{Editor: "vscode-server", Name: "VS Code Server", Dirs: []string{".vscode-server/extensions"}, Remote: true},
+	{Editor: "vscode-server-insiders", Name: "VS Code Server Insiders", Dirs: []string{".vscode-server-insiders/extensions"}, Remote: true},
+}
+
+func productJSONGlobs() []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{
+			"/Applications/*.app/Contents/Resources/app/product.json",
+			filepath.Join(GlobEscape(UserHomeDir()), "Applications/*.app/Contents/Resources/app/product.json"),
+		}
+	case "windows":
+		globs := []string{}
+		for _, env := range []string{"LOCALAPPDATA", "ProgramFiles"} {
+			if base := os.Getenv(env); base != "" {
+				pattern := `*\resources\app\product.json`
+				if env == "LOCALAPPDATA" {
+					pattern = `Programs\` + pattern
+				}
+				globs = append(globs, filepath.Join(GlobEscape(base), pattern))
+			}
+		}
+		return globs
+	default:
+		return []string{"/usr/share/*/resources/app/product.json", "/opt/*/resources/app/product.json"}
+	}
+}
+
+func ProductCatalog() []catalogEntry {
+	entries := []catalogEntry{}
+	for _, pattern := range productJSONGlobs() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			content, err := os.ReadFile(match)
+			if err != nil {
+				continue
+			}
+			var product struct {
+				NameShort       string `json:"nameShort"`
+				ApplicationName string `json:"applicationName"`
+				DataFolderName  string `json:"dataFolderName"`
+			}
+			if err := json.Unmarshal(content, &product); err != nil || product.ApplicationName == "" || product.DataFolderName == "" {
+				continue
+			}
+			known := false
+			for _, entry := range EditorCatalog {
+				for _, dir := range entry.Dirs {
+					if dir == product.DataFolderName+"/extensions" {
+						known = true
+					}
+				}
+			}
+			if known {
+				continue
+			}
+			entries = append(entries, catalogEntry{Editor: product.ApplicationName, Name: product.NameShort, Dirs: []string{product.DataFolderName + "/extensions"}})
+		}
+	}
+	return entries
+}
+
+func systemExtensionRoots() []Root {
+	roots := []Root{}
+	for _, pattern := range productJSONGlobs() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			dir := filepath.Join(filepath.Dir(match), "extensions")
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				continue
+			}
+			editor := "system"
+			var product struct {
+				DataFolderName string `json:"dataFolderName"`
+			}
+			if content, err := os.ReadFile(match); err == nil && json.Unmarshal(content, &product) == nil {
+				for _, entry := range EditorCatalog {
+					for _, catalogDir := range entry.Dirs {
+						if catalogDir == product.DataFolderName+"/extensions" {
+							editor = entry.Editor
+						}
+					}
+				}
+			}
+			roots = append(roots, Root{Editor: editor, Path: dir})
+		}
+	}
+	return roots
+}
+
+func CatalogName(editor string) string {
+	for _, entry := range EditorCatalog {
+		if entry.Editor == editor && entry.Name != "" {
+			return entry.Name
+		}
+	}
+	if editor == "" {
+		return "other"
+	}
+	return editor
+}
+
+func DefaultCatalogPath() string {
+	return DataPath("catalog.json")
+}
+
+func LoadCatalog(catalogPath string, required bool) error {
+	content, err := os.ReadFile(catalogPath)
+	if err != nil {
+		if !required && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := []catalogEntry{}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("%s: %s", catalogPath, err.Error())
+	}
+	for _, entry := range entries {
+		if entry.Editor == "" || len(entry.Dirs) == 0 {
+			return fmt.Errorf("%s: every entry needs \"editor\" and \"dirs\"", catalogPath)
+		}
+	}
+	EditorCatalog = append(EditorCatalog, entries...)
+	return nil
+}
+
+func wslDistros() []string {
+	for _, server := range []string{`\\wsl.localhost\`, `\\wsl$\`} {
+		entries, err := os.ReadDir(server)
+		if err != nil || len(entries) == 0 {
+			continue
+		}
+		distros := []string{}
+		for _, entry := range entries {
+			distros = append(distros, server+entry.Name())
+		}
+		return distros
+	}
+	out, err := exec.Command("wsl.exe", "--list", "--quiet").Output()
+	if err != nil {
+		return nil
+	}
+	units := []uint16{}
+	for i := 0; i+1 < len(out); i += 2 {
+		units = append(units, uint16(out[i])|uint16(out[i+1])<<8)
+	}
+	distros := []string{}
+	for _, name := range strings.Fields(string(utf16.Decode(units))) {
+		distros = append(distros, `\\wsl$\`+strings.TrimPrefix(name, "\ufeff"))
+	}
+	return distros
+}
+
+func wslHomes() []string {
+	homes := []string{}
+	for _, distro := range wslDistros() {
+		entries, _ := os.ReadDir(filepath.Join(distro, "home"))
+		for _, entry := range entries {
+			if entry.IsDir() {
+				homes = append(homes, filepath.Join(distro, "home", entry.Name()))
+			}
+		}
+		if _, err := os.Stat(filepath.Join(distro, "root")); err == nil {
+			homes = append(homes, filepath.Join(distro, "root"))
+		}
+	}
+	return homes
+}
+
+func homeBases() []string {
+	if discoveryConfig.PerMachine || discoveryConfig.AllUsers {
+		bases := userProfiles()
+		if home := UserHomeDir(); discoveryConfig.AllUsers && home != "" {
+			own := false
+			for _, base := range bases {
+				if base == home {
+					own = true
+				}
+			}
+			if !own {
+				bases = append(bases, home)
+			}
+		}
+		if discoveryConfig.WSL {
+			bases = append(bases, wslHomes()...)
+		}
+		return bases
+	}
+	bases := []string{UserHomeDir()}
+	if runtime.GOOS == "windows" {
+		userProfile := os.Getenv("USERPROFILE")
+		if userProfile == "" {
+			userProfile = UserHomeDir()
+		}
+		bases = append(bases, userProfile)
+		if discoveryConfig.WSL {
+			bases = append(bases, wslHomes()...)
+		}
+	}
+	return bases
+}
+
+func ExpandCatalogDir(base, dir string) string {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		return filepath.Join(base, filepath.FromSlash(strings.TrimPrefix(dir, "~")))
+	}
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(base, filepath.FromSlash(dir))
+}
+
+// Settings carries the flags and config that decide which homes,
+// editors and extension directories are searched and which folders count.
+type Settings struct {
+	PerMachine      bool
+	AllUsers        bool
+	WSL             bool
+	NoCache         bool
+	IncludeInactive bool
+	AllVersions     bool
+	AssumedVersion  string
+	Editors         []string
+	ExtraDirs       []Root
+	DirOverrides    map[string]string
+}
+
+var discoveryConfig Settings
+
+// Configure replaces the settings every later scan, path and version
+// lookup reads. The cli package calls it once the flags and config have been resolved.
+func Configure(settings Settings) {
+	discoveryConfig = settings
+}
+
+var EditorCLIs = [][2]string{{"code", "vscode"}, {"code-insiders", "vscode-insiders"}, {"codium", "vscodium"}, {"cursor", "cursor"}, {"windsurf", "windsurf"}}
+
+func CLIRoots() []Root {
+	roots := []Root{}
+	for _, cli := range EditorCLIs {
+		binary, err := exec.LookPath(cli[0])
+		if err != nil {
+			continue
+		}
+		for _, spec := range discoverySpecs {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			out, err := exec.CommandContext(ctx, binary, "--locate-extension", spec.Publisher).Output()
+			cancel()
+			if err != nil {
+				output.Logf("[note]    %s --locate-extension %s failed: %s\n", cli[0], spec.Publisher, err.Error())
+				continue
+			}
+			for _, line := range strings.Split(string(out), "\n") {
+				located := strings.TrimSpace(line)
+				if info, err := os.Stat(located); located == "" || err != nil || !info.IsDir() {
+					continue
+				}
+				roots = append(roots, Root{Editor: cli[1], Path: filepath.Dir(located)})
+			}
+		}
+	}
+	return roots
+}
+
+func Roots() []Root {
+	roots := []Root{}
+	seen := map[string]struct{}{}
+	for _, entry := range EditorCatalog {
+		if len(discoveryConfig.Editors) > 0 {
+			selected := false
+			for _, editor := range discoveryConfig.Editors {
+				if editor == entry.Editor {
+					selected = true
+				}
+			}
+			if !selected {
+				continue
+			}
+		}
+		if len(entry.OS) > 0 {
+			matched := false
+			for _, goos := range entry.OS {
+				if goos == runtime.GOOS {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		if override, ok := discoveryConfig.DirOverrides[entry.Editor]; ok {
+			if _, ok := seen[override]; !ok {
+				seen[override] = struct{}{}
+				roots = append(roots, Root{Editor: entry.Editor, Path: override})
+			}
+			continue
+		}
+		for _, base := range homeBases() {
+			for _, dir := range entry.Dirs {
+				if base == "" && !filepath.IsAbs(dir) {
+					continue
+				}
+				root := ExpandCatalogDir(base, dir)
+				if _, ok := seen[root]; ok {
+					continue
+				}
+				seen[root] = struct{}{}
+				roots = append(roots, Root{Editor: entry.Editor, Path: root, UserData: userDataDir(base, entry.UserData)})
+			}
+		}
+	}
+	extras := discoveryConfig.ExtraDirs
+	if discoveryConfig.AllUsers {
+		extras = append(systemExtensionRoots(), extras...)
+	}
+	for _, extra := range extras {
+		if _, ok := seen[extra.Path]; ok {
+			continue
+		}
+		seen[extra.Path] = struct{}{}
+		roots = append(roots, extra)
+	}
+	return roots
+}
+
+type discoverySpec struct {
+	Name      string   `json:"name"`
+	Publisher string   `json:"publisher"`
+	Assets    []string `json:"assets"`
+	Probes    []string `json:"probes,omitempty"`
+}
+
+var discoverySpecs = []discoverySpec{
+	{Name: "codex-webview", Publisher: "openai.chatgpt", Assets: []string{"webview/assets/index-*.js"}},
+	{Name: "codex-extension-host", Publisher: "openai.chatgpt", Assets: []string{"out/extension.js"}, Probes: []string{"CHAT_GPT_AUTH_ONLY_MODELS"}},
+}
+
+func DefaultSpecsPath() string {
+	return DataPath("discovery.json")
+}
+
+func LoadSpecs(specsPath string, required bool) error {
+	content, err := os.ReadFile(specsPath)
+	if err != nil {
+		if !required && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	specs := []discoverySpec{}
+	if err := json.Unmarshal(content, &specs); err != nil {
+		return fmt.Errorf("%s: %s", specsPath, err.Error())
+	}
+	for _, spec := range specs {
+		if spec.Publisher == "" || len(spec.Assets) == 0 {
+			return fmt.Errorf("%s: every spec needs \"publisher\" and \"assets\"", specsPath)
+		}
+		for _, asset := range spec.Assets {
+			if _, err := path.Match(asset, ""); err != nil {
+				return fmt.Errorf("%s: invalid asset glob %q", specsPath, asset)
+			}
+		}
+	}
+	discoverySpecs = append(discoverySpecs, specs...)
+	return nil
+}
+
+func matchesProbes(filePath string, probes []string) bool {
+	if len(probes) == 0 {
+		return true
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return false
+	}
+	for _, probe := range probes {
+		if !strings.Contains(string(content), probe) {
+			return false
+		}
+	}
+	return true
+}
+
+func GlobEscape(literal string) string {
+	var escaped strings.Builder
+	for _, r := range literal {
+		switch {
+		case r == '*' || r == '?' || r == '[':
+			escaped.WriteString("[" + string(r) + "]")
+		case r == '\\' && filepath.Separator != '\\':
+			escaped.WriteString(`\\`)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+func hasPrefixFold(name, prefix string) bool {
+	return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+}
+
+var reportedInactive = map[string]bool{}
+
+func activeExtensionDirs(root, userData string) map[string][]string {
+	active := installedExtensions(filepath.Join(root, "extensions.json"))
+	if active == nil || userData == "" {
+		return active
+	}
+	content, err := os.ReadFile(filepath.Join(userData, "User", "globalStorage", "storage.json"))
+	if err != nil {
+		return active
+	}
+	var storage struct {
+		Profiles []struct {
+			Location string `json:"location"`
+		} `json:"userDataProfiles"`
+	}
+	if err := json.Unmarshal(content, &storage); err != nil {
+		return active
+	}
+	for _, profile := range storage.Profiles {
+		if profile.Location == "" {
+			continue
+		}
+		for id, folders := range installedExtensions(filepath.Join(userData, "User", "profiles", profile.Location, "extensions.json")) {
+			active[id] = append(active[id], folders...)
+		}
+	}
+	return active
+}
+
+func installedExtensions(manifestPath string) map[string][]string {
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil
+	}
+	var installed []struct {
+		Identifier struct {
+			ID string `json:"id"`
+		} `json:"identifier"`
+		RelativeLocation string `json:"relativeLocation"`
+		Location         struct {
+			Path   string `json:"path"`
+			FsPath string `json:"fsPath"`
+		} `json:"location"`
+	}
+	if err := json.Unmarshal(content, &installed); err != nil {
+		return nil
+	}
+	active := map[string][]string{}
+	for _, item := range installed {
+		folder := item.RelativeLocation
+		if folder == "" {
+			folder = path.Base(filepath.ToSlash(item.Location.FsPath))
+		}
+		if folder == "" || folder == "." {
+			folder = path.Base(item.Location.Path)
+		}
+		id := strings.ToLower(item.Identifier.ID)
+		active[id] = append(active[id], strings.ToLower(folder))
+	}
+	return active
+}
+
+func listedActive(active map[string][]string, publisher, folder string) bool {
+	for _, candidate := range active[strings.ToLower(publisher)] {
+		if candidate == strings.ToLower(folder) {
+			return true
+		}
+	}
+	return false
+}
+
+func inactiveVariant(root, folder, publisher string, active map[string][]string) bool {
+	folders, ok := active[strings.ToLower(publisher)]
+	if !ok || discoveryConfig.IncludeInactive {
+		return false
+	}
+	for _, candidate := range folders {
+		if candidate == strings.ToLower(folder) {
+			return false
+		}
+	}
+	key := filepath.Join(root, folder)
+	if !reportedInactive[key] {
+		reportedInactive[key] = true
+		output.Logf("[skip]    %s (installed but not used by any profile; extensions.json selects %s; use --include-inactive to patch it)\n", key, strings.Join(folders, ", "))
+	}
+	return true
+}
+
+var reportedLayout = map[string]bool{}
+
+var reportedStale = map[string]bool{}
+
+func folderVersion(folder, publisher string) string {
+	rest := folder[len(publisher):]
+	if !strings.HasPrefix(rest, "-") {
+		return ""
+	}
+	version := strings.SplitN(rest[1:], "-", 2)[0]
+	if !regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`).MatchString(version) {
+		return ""
+	}
+	return version
+}
+
+func diagnoseLayout(extDir string, spec discoverySpec) {
+	if reportedLayout[extDir] {
+		return
+	}
+	reportedLayout[extDir] = true
+	entries, err := os.ReadDir(extDir)
+	if err != nil {
+		return
+	}
+	top := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		top = append(top, name)
+	}
+	output.Logf("[hint]    %s: no file matches %s; top-level layout: %s\n", extDir, strings.Join(spec.Assets, ", "), strings.Join(top, " "))
+	for _, asset := range spec.Assets {
+		dir := filepath.Join(extDir, filepath.FromSlash(path.Dir(asset)))
+		listing, err := os.ReadDir(dir)
+		if err != nil {
+			output.Logf("[hint]    %s does not exist\n", dir)
+			continue
+		}
+		names := []string{}
+		for _, entry := range listing {
+			names = append(names, entry.Name())
+		}
+		if len(names) == 0 {
+			names = append(names, "(empty)")
+		}
+		output.Logf("[hint]    %s contains: %s\n", dir, strings.Join(names, " "))
+	}
+	candidates := []string{}
+	filepath.WalkDir(extDir, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(extDir, current)
+		if entry.IsDir() {
+			if entry.Name() == "node_modules" || strings.Count(filepath.ToSlash(rel), "/") >= 4 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(entry.Name(), ".js") {
+			return nil
+		}
+		if info, err := entry.Info(); err != nil || info.Size() > 32<<20 {
+			return nil
+		}
+		content, err := os.ReadFile(current)
+		if err == nil && len(rules.MissingAnchors(rules.UnpackText(string(content)))) < 3 {
+			candidates = append(candidates, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	for _, candidate := range candidates {
+		glob := candidate
+		base := path.Base(candidate)
+		if dash := strings.LastIndex(base, "-"); dash > 0 {
+			glob = path.Join(path.Dir(candidate), base[:dash]+"-*.js")
+		}
+		suggested, _ := json.Marshal([]discoverySpec{{Name: spec.Name, Publisher: spec.Publisher, Assets: []string{glob}}})
+		output.Logf("[hint]    %s holds the model arrays; patch it directly or add a discovery spec with --discovery-spec: %s\n", filepath.Join(extDir, filepath.FromSlash(candidate)), suggested)
+	}
+	if len(candidates) == 0 {
+		output.Logln("[hint]    no .js file in the extension contains the model arrays; the bundle format may have changed upstream")
+	}
+}
+
+type discoveredTarget struct {
+	Path    string
+	Editor  string
+	version string
+	kind    string
+}
+
+var assetKinds = map[string]string{"bundle": "", "backup": ".bak"}
+
+const discoveryCacheTTL = time.Hour
+
+type cacheStamp struct {
+	Path    string `json:"path"`
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+}
+
+type cachedTarget struct {
+	cacheStamp
+	Editor  string `json:"editor"`
+	Version string `json:"version"`
+}
+
+type cachedDiscovery struct {
+	CreatedAt string         `json:"created_at"`
+	Targets   []cachedTarget `json:"targets"`
+}
+
+func stampFile(filePath string) cacheStamp {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return cacheStamp{Path: filePath, ModTime: -1}
+	}
+	return cacheStamp{Path: filePath, ModTime: info.ModTime().UnixNano(), Size: info.Size()}
+}
+
+func discoveryCachePath() string {
+	if home := HomePath(); home == "" && !discoveryConfig.PerMachine {
+		return ""
+	}
+	return DataPath("cache.json")
+}
+
+func DiscoverTargets(kind string) []discoveredTarget {
+	roots := Roots()
+	cachePath := discoveryCachePath()
+	// Backups appear and disappear with every patch and restore without touching the
+	// stamped folders, so a cached backup list goes stale; always scan for them.
+	if discoveryConfig.NoCache || cachePath == "" || kind == "backup" {
+		return scanTargets(kind, roots)
+	}
+	rootKeys := []string{}
+	stamps := []cacheStamp{}
+	for _, root := range roots {
+		rootKeys = append(rootKeys, root.Editor+"="+root.Path)
+		stamps = append(stamps, stampFile(root.Path), stampFile(filepath.Join(root.Path, "extensions.json")))
+		if root.UserData != "" {
+			stamps = append(stamps, stampFile(filepath.Join(root.UserData, "User", "globalStorage", "storage.json")))
+		}
+	}
+	encodedKey, _ := json.Marshal([]any{kind, rootKeys, discoverySpecs, discoveryConfig.AllVersions, discoveryConfig.IncludeInactive, stamps})
+	key := SHA256Hex(encodedKey)
+	cache := map[string]cachedDiscovery{}
+	if content, err := os.ReadFile(cachePath); err == nil {
+		json.Unmarshal(content, &cache)
+	}
+	if entry, ok := cache[key]; ok {
+		created, err := time.Parse(time.RFC3339, entry.CreatedAt)
+		fresh := err == nil && time.Since(created) < discoveryCacheTTL && len(entry.Targets) > 0
+		for _, target := range entry.Targets {
+			if fresh && stampFile(target.Path) != target.cacheStamp {
+				fresh = false
+			}
+		}
+		if fresh {
+			found := make([]discoveredTarget, 0, len(entry.Targets))
+			for _, target := range entry.Targets {
+				found = append(found, discoveredTarget{Path: target.Path, Editor: target.Editor, version: target.Version, kind: kind})
+			}
+			return found
+		}
+	}
+	found := scanTargets(kind, roots)
+	if len(found) == 0 {
+		return found
+	}
+	entry := cachedDiscovery{CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	for _, target := range found {
+		entry.Targets = append(entry.Targets, cachedTarget{cacheStamp: stampFile(target.Path), Editor: target.Editor, Version: target.version})
+	}
+	for cachedKey, cached := range cache {
+		if created, err := time.Parse(time.RFC3339, cached.CreatedAt); err != nil || time.Since(created) >= discoveryCacheTTL {
+			delete(cache, cachedKey)
+		}
+	}
+	cache[key] = entry
+	if encoded, err := json.MarshalIndent(cache, "", "  "); err == nil && os.MkdirAll(filepath.Dir(cachePath), 0o755) == nil {
+		os.WriteFile(cachePath, encoded, 0o644)
+	}
+	return found
+}
+
+func scanTargets(kind string, roots []Root) []discoveredTarget {
+	suffix := assetKinds[kind]
+	found := []discoveredTarget{}
+	seen := map[string]struct{}{}
+	for _, discovered := range roots {
+		root := discovered.Path
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		active := activeExtensionDirs(root, discovered.UserData)
+		newest := map[string]string{}
+		for _, entry := range entries {
+			for _, spec := range discoverySpecs {
+				if suffix != "" || discoveryConfig.AllVersions || !entryIsDir(root, entry) || !hasPrefixFold(entry.Name(), spec.Publisher) || inactiveVariant(root, entry.Name(), spec.Publisher, active) {
+					continue
+				}
+				if version := folderVersion(entry.Name(), spec.Publisher); version != "" && (newest[spec.Publisher] == "" || rules.CompareVersions(version, newest[spec.Publisher]) > 0) {
+					newest[spec.Publisher] = version
+				}
+			}
+		}
+		for _, entry := range entries {
+			if !entryIsDir(root, entry) {
+				continue
+			}
+			for _, spec := range discoverySpecs {
+				if !hasPrefixFold(entry.Name(), spec.Publisher) {
+					continue
+				}
+				if suffix == "" && inactiveVariant(root, entry.Name(), spec.Publisher, active) {
+					continue
+				}
+				if version := folderVersion(entry.Name(), spec.Publisher); version != "" && newest[spec.Publisher] != "" && rules.CompareVersions(version, newest[spec.Publisher]) < 0 && !listedActive(active, spec.Publisher, entry.Name()) {
+					key := filepath.Join(root, entry.Name())
+					if !reportedStale[key] {
+						reportedStale[key] = true
+						output.Logf("[skip]    %s (version %s left behind; newest installed is %s; use --all-versions to patch it)\n", key, version, newest[spec.Publisher])
+					}
+					continue
+				}
+				matched := 0
+				for _, asset := range spec.Assets {
+					matches, err := filepath.Glob(filepath.Join(GlobEscape(root), GlobEscape(entry.Name()), filepath.FromSlash(asset+suffix)))
+					if err != nil {
+						continue
+					}
+					if suffix != "" {
+						bundles, _ := filepath.Glob(filepath.Join(GlobEscape(root), GlobEscape(entry.Name()), filepath.FromSlash(asset)))
+						for _, bundle := range bundles {
+							if resolved, err := ResolveLink(bundle); err == nil && resolved != bundle {
+								if _, err := os.Stat(resolved + suffix); err == nil {
+									matches = append(matches, resolved+suffix)
+								}
+							}
+						}
+					}
+					matched += len(matches)
+					sort.Strings(matches)
+					for _, match := range matches {
+						real, err := filepath.EvalSymlinks(match)
+						if err != nil {
+							continue
+						}
+						if _, ok := seen[real]; ok {
+							continue
+						}
+						if info, err := os.Stat(match); err != nil || info.IsDir() {
+							continue
+						}
+						if !matchesProbes(match, spec.Probes) {
+							continue
+						}
+						seen[real] = struct{}{}
+						found = append(found, discoveredTarget{Path: match, Editor: discovered.Editor, version: TargetVersion(match), kind: kind})
+					}
+				}
+				if matched == 0 && suffix == "" && len(spec.Probes) == 0 {
+					diagnoseLayout(filepath.Join(root, entry.Name()), spec)
+				}
+			}
+		}
+	}
+	return found
+}
+
+func entryIsDir(parent string, entry fs.DirEntry) bool {
+	if entry.Type()&fs.ModeSymlink == 0 {
+		return entry.IsDir()
+	}
+	info, err := os.Stat(filepath.Join(parent, entry.Name()))
+	return err == nil && info.IsDir()
+}
+
+func ResolveLink(target string) (string, error) {
+	info, err := os.Lstat(target)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return target, nil
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return "", fmt.Errorf("%s: cannot resolve symlink: %s", target, err.Error())
+	}
+	return real, nil
+}
+
+func ScanTree(dir string) []string {
+	found := []string{}
+	filepath.WalkDir(dir, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matched, _ := path.Match("index-*.js", entry.Name()); !matched && entry.Name() != "extension.js" {
+			return nil
+		}
+		content, err := os.ReadFile(current)
+		if err == nil && strings.Contains(rules.UnpackText(string(content)), "DEFAULT_MODEL_ORDER") {
+			found = append(found, current)
+		}
+		return nil
+	})
+	return found
+}
+
+func targetPaths(targets []discoveredTarget) []string {
+	paths := make([]string, 0, len(targets))
+	for _, target := range targets {
+		paths = append(paths, target.Path)
+	}
+	return paths
+}
+
+func AutoDiscover() []string {
+	return targetPaths(DiscoverTargets("bundle"))
+}
+
+func AutoDiscoverBaks() []string {
+	if BackupDir == "" {
+		return targetPaths(DiscoverTargets("backup"))
+	}
+	baks := []string{}
+	for _, target := range targetPaths(DiscoverTargets("bundle")) {
+		if _, err := os.Stat(BackupPath(target)); err == nil {
+			baks = append(baks, BackupPath(target))
+		}
+	}
+	return baks
+}
+
+func extensionVersion(extDir string) string {
+	content, err := os.ReadFile(filepath.Join(extDir, "package.json"))
+	if err != nil {
+		return ""
+	}
+	var manifest struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return ""
+	}
+	return manifest.Version
+}
+
+func TargetVersion(target string) string {
+	if extDir := ExtensionDirFor(target); extDir != "" {
+		if version := extensionVersion(extDir); version != "" {
+			return version
+		}
+	}
+	return discoveryConfig.AssumedVersion
+}
+
+func InstalledVersions() []string {
+	versions := []string{}
+	for _, discovered := range Roots() {
+		root := discovered.Path
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !hasPrefixFold(entry.Name(), "openai.chatgpt") {
+				continue
+			}
+			if version := extensionVersion(filepath.Join(root, entry.Name())); version != "" {
+				versions = append(versions, version)
+			} else if discoveryConfig.AssumedVersion != "" {
+				versions = append(versions, discoveryConfig.AssumedVersion)
+			}
+		}
+	}
+	return versions
+}
+
+func snapName(filePath string) string {
+	parts := strings.Split(filepath.ToSlash(StateKey(filePath)), "/")
+	for i, part := range parts {
+		if part == "snap" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+func ConfinementHint(filePath string, err error) string {
+	if runtime.GOOS != "linux" || !(errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS)) {
+		return ""
+	}
+	if name := os.Getenv("SNAP_NAME"); name != "" {
+		return fmt.Sprintf("this process runs inside the %s snap and cannot write outside its confinement; run the patcher as a normal binary outside the snap", name)
+	}
+	absPath := filepath.ToSlash(StateKey(filePath))
+	if strings.HasPrefix(absPath, "/snap/") {
+		return "files under /snap are a read-only squashfs; install the extension into your user extensions dir (code --install-extension) and patch that copy instead"
+	}
+	if name := snapName(filePath); name != "" {
+		return fmt.Sprintf("this file belongs to the %s snap; open `snap run --shell %s` and re-run the patcher from that shell so it has the snap's permissions", name, name)
+	}
+	return ""
+}
+
+var BackupDir string
+
+// SetBackupDir keeps new backups under dir, mirroring each bundle's absolute
+// path; empty keeps them next to the bundle.
+func SetBackupDir(dir string) {
+	BackupDir = dir
+}
+
+func BackupPath(file string) string {
+	if BackupDir == "" {
+		return file + ".bak"
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+	volume := filepath.VolumeName(abs)
+	return filepath.Join(BackupDir, strings.Trim(volume, `\:`), strings.TrimPrefix(abs, volume)) + ".bak"
+}
+
+func BackupOriginal(bakPath string) string {
+	original := strings.TrimSuffix(bakPath, ".bak")
+	if BackupDir == "" {
+		return original
+	}
+	rel, err := filepath.Rel(BackupDir, original)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return original
+	}
+	if runtime.GOOS == "windows" {
+		volume, rest, _ := strings.Cut(rel, string(filepath.Separator))
+		return volume + `:\` + rest
+	}
+	return string(filepath.Separator) + rel
+}
+
+var homeWarning sync.Once
+
+func UserHomeDir() string {
+	if home := os.Getenv("CODEX_AUTOPATCH_HOME"); home != "" {
+		return home
+	}
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		return home
+	}
+	if account, err := user.Current(); err == nil && account.HomeDir != "" {
+		return account.HomeDir
+	}
+	homeWarning.Do(func() {
+		output.Logln(output.Say("[note]    无法确定用户主目录（HOME 未设置），将跳过主目录下的扩展、状态和配置文件；可通过 CODEX_AUTOPATCH_HOME 指定", "[note]    cannot determine the home directory (HOME is not set); extensions, state and config under it are skipped. Set CODEX_AUTOPATCH_HOME to choose one"))
+	})
+	return ""
+}
+
+func MachineDataDir() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "codex-autopatch")
+	}
+	return "/var/lib/codex-autopatch"
+}
+
+func DataPath(name string) string {
+	if discoveryConfig.PerMachine {
+		return filepath.Join(MachineDataDir(), name)
+	}
+	return HomePath(".codex-autopatch", name)
+}
+
+func userProfiles() []string {
+	parent := "/home"
+	skip := map[string]bool{}
+	switch runtime.GOOS {
+	case "windows":
+		parent = filepath.Join(os.Getenv("SystemDrive")+`\`, "Users")
+		if public := os.Getenv("PUBLIC"); public != "" {
+			parent = filepath.Dir(public)
+		}
+		skip = map[string]bool{"public": true, "default": true, "default user": true, "all users": true, "defaultapppool": true}
+	case "darwin":
+		parent = "/Users"
+		skip = map[string]bool{"shared": true, "guest": true}
+	}
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		return nil
+	}
+	profiles := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || skip[strings.ToLower(entry.Name())] || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		profiles = append(profiles, filepath.Join(parent, entry.Name()))
+	}
+	return profiles
+}
+
+func HomePath(parts ...string) string {
+	home := UserHomeDir()
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(append([]string{home}, parts...)...)
+}
+
+func ConfigPath() string {
+	if discoveryConfig.PerMachine {
+		return DataPath("config.toml")
+	}
+	return HomePath(".codex-autopatch.toml")
+}
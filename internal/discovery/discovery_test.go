@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHasPrefixFold(t *testing.T) {
+	cases := []struct {
+		name, prefix string
+		want         bool
+	}{
+		{"openai.chatgpt-0.4.12", "openai.chatgpt", true},
+		{"OpenAI.chatgpt-0.4.12", "openai.chatgpt", true},
+		{"OPENAI.CHATGPT-0.4.12-win32-x64", "openai.chatgpt", true},
+		{"openai.chatgpt-0.4.12", "OpenAI.chatgpt", true},
+		{"openai.chat", "openai.chatgpt", false},
+		{"openai-chatgpt-0.4.12", "openai.chatgpt", false},
+		{"其他.chatgpt-0.4.12", "openai.chatgpt", false},
+		{"", "openai.chatgpt", false},
+	}
+	for _, c := range cases {
+		if got := hasPrefixFold(c.name, c.prefix); got != c.want {
+			t.Errorf("hasPrefixFold(%q, %q) = %v, want %v", c.name, c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestDiscoveryMatchesPublisherCaseInsensitively(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CODEX_AUTOPATCH_HOME", home)
+	assets := filepath.Join(home, ".vscode", "extensions", "OpenAI.chatgpt-0.4.12", "webview", "assets")
+	if err := os.MkdirAll(assets, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(assets, "index-abc.js"), []byte(`M={apikey:["gpt-5"],chatgpt:DEFAULT_MODELS};`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := AutoDiscover(); len(got) != 1 {
+		t.Fatalf("found %d bundles in OpenAI.chatgpt-0.4.12, want 1", len(got))
+	}
+}
+
+func TestGlobEscapeUnicode(t *testing.T) {
+	cases := []struct{ literal, want string }{
+		{"用户/扩展", "用户/扩展"},
+		{"プロジェクト 🚀", "プロジェクト 🚀"},
+		{"备份[1]*?", "备份[[]1][*][?]"},
+		{"😀[😀]", "😀[[]😀]"},
+	}
+	for _, c := range cases {
+		got := GlobEscape(c.literal)
+		if got != c.want {
+			t.Errorf("globEscape(%q) = %q, want %q", c.literal, got, c.want)
+		}
+		if ok, err := filepath.Match(got, c.literal); err != nil || !ok {
+			t.Errorf("escaped %q does not match its literal: %v %v", got, ok, err)
+		}
+	}
+}
+
+func TestBackupPathUnicode(t *testing.T) {
+	root := t.TempDir()
+	cases := []struct{ dir, file string }{
+		{"用户", "index-中文.js"},
+		{"ユーザー 🚀", "index-abc.js"},
+		{"😀 [beta]", "index-😀.js"},
+	}
+	defer SetBackupDir(BackupDir)
+	for _, c := range cases {
+		file := filepath.Join(root, c.dir, c.file)
+		SetBackupDir("")
+		if got := BackupPath(file); got != file+".bak" {
+			t.Errorf("backupPath(%q) = %q, want the sibling .bak", file, got)
+		}
+		SetBackupDir(filepath.Join(root, "备份"))
+		got := BackupPath(file)
+		if !strings.HasPrefix(got, BackupDir+string(filepath.Separator)) || !strings.HasSuffix(got, filepath.Join(c.dir, c.file)+".bak") {
+			t.Errorf("backupPath(%q) = %q, want it mirrored under %q", file, got, BackupDir)
+		}
+		if original := BackupOriginal(got); original != file {
+			t.Errorf("backupOriginal(%q) = %q, want %q", got, original, file)
+		}
+	}
+}
+
+func TestDiscoveryCacheSeesRestoreAndInstall(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("CODEX_AUTOPATCH_HOME", home)
+	t.Setenv("HOME", home)
+	if got := DiscoverTargets("bundle"); len(got) != 0 {
+		t.Fatalf("found %d bundles in an empty home", len(got))
+	}
+	assets := filepath.Join(home, ".vscode", "extensions", "openai.chatgpt-0.4.12", "webview", "assets")
+	if err := os.MkdirAll(assets, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(assets, "index-abc.js")
+	if err := os.WriteFile(bundle, []byte(`M={apikey:["gpt-5"],chatgpt:DEFAULT_MODELS};`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := DiscoverTargets("bundle"); len(got) != 1 {
+		t.Fatalf("install not seen after an empty cached scan: %d bundles", len(got))
+	}
+	if got := DiscoverTargets("backup"); len(got) != 0 {
+		t.Fatalf("found %d backups before patching", len(got))
+	}
+	if err := os.WriteFile(bundle+".bak", []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := DiscoverTargets("backup"); len(got) != 1 {
+		t.Fatalf("backup not seen after patching: %d backups", len(got))
+	}
+	os.Remove(bundle + ".bak")
+	if got := DiscoverTargets("backup"); len(got) != 0 {
+		t.Fatalf("restored backup still listed: %d backups", len(got))
+	}
+}
@@ -0,0 +1,101 @@
+// Package output formats and filters what the tool prints.
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	LevelQuiet = iota
+	LevelNormal
+	LevelVerbose
+)
+
+var LogLevel = LevelNormal
+
+// SetLogLevel picks how much Logf, Logln and FilterLog let through.
+func SetLogLevel(level int) {
+	LogLevel = level
+}
+
+func Logf(format string, args ...any) {
+	if LogLevel >= LevelNormal || strings.HasPrefix(format, "[error]") {
+		fmt.Printf(format, args...)
+	}
+}
+
+func Logln(line string) {
+	if LogLevel >= LevelNormal || strings.HasPrefix(line, "[error]") {
+		fmt.Println(line)
+	}
+}
+
+func Debugf(w io.Writer, format string, args ...any) {
+	if LogLevel >= LevelVerbose {
+		fmt.Fprintf(w, "[debug]   "+format, args...)
+	}
+}
+
+func FilterLog(output []byte) []byte {
+	if LogLevel >= LevelNormal {
+		return output
+	}
+	kept := []byte{}
+	for _, line := range bytes.SplitAfter(output, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("[error]")) {
+			kept = append(kept, line...)
+		}
+	}
+	return kept
+}
+
+type LineWriter struct {
+	Mu      *sync.Mutex
+	Prefix  string
+	pending []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		w.Mu.Lock()
+		if len(FilterLog(w.pending[:end+1])) > 0 {
+			fmt.Printf("%s%s\n", w.Prefix, w.pending[:end])
+		}
+		w.Mu.Unlock()
+		w.pending = w.pending[end+1:]
+	}
+}
+
+var Languages = []string{"zh", "en"}
+
+var Language = "zh"
+
+// SetLanguage picks the language of the summary messages.
+func SetLanguage(lang string) {
+	Language = lang
+}
+
+func ValidLanguage(lang string) bool {
+	for _, known := range Languages {
+		if lang == known {
+			return true
+		}
+	}
+	return false
+}
+
+func Say(zh, en string) string {
+	if Language == "en" {
+		return en
+	}
+	return zh
+}
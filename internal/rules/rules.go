@@ -0,0 +1,1470 @@
+// Package rules rewrites the model arrays in a Codex webview bundle and checks
+// the result.
+package rules
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/huangang/codex-autopatch/internal/output"
+)
+
+func parseDefaultOrder(text string) []string {
+	pattern := regexp.MustCompile(`DEFAULT_MODEL_ORDER=\[([^\[\]]+)\]`)
+	literal := regexp.MustCompile(`^(?:"[^"\\]*"|'[^'\\]*')$`)
+	match := pattern.FindStringSubmatch(text)
+	if match == nil {
+		return []string{}
+	}
+	parts := strings.Split(match[1], ",")
+	items := make([]string, 0, len(parts))
+	for _, part := range parts {
+		value := strings.TrimSpace(part)
+		if literal.MatchString(value) {
+			items = append(items, value)
+		}
+	}
+	return items
+}
+
+func findCodexMaxVersions(text string) []string {
+	pattern := regexp.MustCompile(`gpt-[0-9](?:\.[0-9]+)?-codex-max`)
+	matches := pattern.FindAllString(text, -1)
+	unique := map[string]struct{}{}
+	for _, match := range matches {
+		unique[match] = struct{}{}
+	}
+	versions := make([]string, 0, len(unique))
+	for value := range unique {
+		versions = append(versions, value)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		ai := versionParts(versions[i])
+		aj := versionParts(versions[j])
+		max := len(ai)
+		if len(aj) > max {
+			max = len(aj)
+		}
+		for idx := 0; idx < max; idx++ {
+			var left, right int
+			if idx < len(ai) {
+				left = ai[idx]
+			}
+			if idx < len(aj) {
+				right = aj[idx]
+			}
+			if left != right {
+				return left > right
+			}
+		}
+		return false
+	})
+	return versions
+}
+
+func findGpt5Models(text string) []string {
+	pattern := regexp.MustCompile(`gpt-5[\w\.-]*`)
+	matches := pattern.FindAllString(text, -1)
+	unique := map[string]struct{}{}
+	for _, match := range matches {
+		unique[match] = struct{}{}
+	}
+	models := make([]string, 0, len(unique))
+	for value := range unique {
+		models = append(models, value)
+	}
+	sort.Strings(models)
+	return models
+}
+
+func StripQuotes(name string) string {
+	trimmed := strings.TrimSpace(name)
+	trimmed = strings.TrimPrefix(trimmed, "\"")
+	trimmed = strings.TrimPrefix(trimmed, "'")
+	trimmed = strings.TrimSuffix(trimmed, "\"")
+	trimmed = strings.TrimSuffix(trimmed, "'")
+	return trimmed
+}
+
+func NormalizeName(name string) string {
+	raw := StripQuotes(name)
+	pattern := regexp.MustCompile(`^(gpt-5)-([0-9]+)([\w\.-]*)$`)
+	match := pattern.FindStringSubmatch(raw)
+	if match == nil {
+		return raw
+	}
+	return fmt.Sprintf("%s.%s%s", match[1], match[2], match[3])
+}
+
+func quote(name string) string {
+	return fmt.Sprintf("\"%s\"", NormalizeName(name))
+}
+
+func versionTuple(name string) []int {
+	pattern := regexp.MustCompile(`gpt-5[.-]([0-9]+(?:\.[0-9]+)?)`)
+	match := pattern.FindStringSubmatch(name)
+	if match == nil {
+		return []int{0}
+	}
+	parts := strings.Split(strings.ReplaceAll(match[1], "-", "."), ".")
+	result := make([]int, 0, len(parts))
+	for _, part := range parts {
+		value, _ := strconv.Atoi(part)
+		result = append(result, value)
+	}
+	return result
+}
+
+func modelSortKey(name string) ([]int, int, string) {
+	version := versionTuple(name)
+	for idx := range version {
+		version[idx] = -version[idx]
+	}
+	category := 2
+	if strings.Contains(name, "codex-max") {
+		category = 0
+	} else if strings.Contains(name, "codex") && !strings.Contains(name, "mini") {
+		category = 1
+	} else if strings.Contains(name, "codex-mini") {
+		category = 3
+	}
+	return version, category, name
+}
+
+func compareTuples(left, right []int) int {
+	max := len(left)
+	if len(right) > max {
+		max = len(right)
+	}
+	for i := 0; i < max; i++ {
+		if i >= len(left) {
+			return -1
+		}
+		if i >= len(right) {
+			return 1
+		}
+		if left[i] != right[i] {
+			if left[i] < right[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(left) - len(right)
+}
+
+func orderModels(models []string, order ModelOrder) []string {
+	normalized := map[string]struct{}{}
+	for _, model := range models {
+		if StripQuotes(model) != "" {
+			normalized[NormalizeName(model)] = struct{}{}
+		}
+	}
+	ordered := make([]string, 0, len(normalized))
+	for model := range normalized {
+		ordered = append(ordered, model)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		aiVersion, aiCategory, aiName := modelSortKey(ordered[i])
+		ajVersion, ajCategory, ajName := modelSortKey(ordered[j])
+		if cmp := compareTuples(aiVersion, ajVersion); cmp != 0 {
+			return (cmp < 0) != order.OldestFirst
+		}
+		if aiCategory != ajCategory {
+			return aiCategory < ajCategory
+		}
+		return aiName < ajName
+	})
+	ordered = moveToFront(moveToFront(ordered, order.Explicit), order.pinFirst)
+	result := make([]string, 0, len(ordered))
+	for _, model := range ordered {
+		result = append(result, quote(model))
+	}
+	return result
+}
+
+var modelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][\w.:-]*$`)
+
+type ModelOrder struct {
+	OldestFirst bool
+	Explicit    []string
+	pinFirst    []string
+}
+
+func moveToFront(ordered, front []string) []string {
+	if len(front) == 0 {
+		return ordered
+	}
+	present := map[string]bool{}
+	for _, model := range ordered {
+		present[model] = true
+	}
+	result := []string{}
+	moved := map[string]bool{}
+	for _, model := range front {
+		name := NormalizeName(model)
+		if present[name] && !moved[name] {
+			result = append(result, name)
+			moved[name] = true
+		}
+	}
+	for _, model := range ordered {
+		if !moved[model] {
+			result = append(result, model)
+		}
+	}
+	return result
+}
+
+func ParseModelOrder(items []string, name string) (ModelOrder, error) {
+	if len(items) == 1 && (items[0] == "newest" || items[0] == "oldest") {
+		return ModelOrder{OldestFirst: items[0] == "oldest"}, nil
+	}
+	explicit, err := ParseModelList(strings.Join(items, ","), name)
+	if err != nil {
+		return ModelOrder{}, err
+	}
+	return ModelOrder{Explicit: explicit}, nil
+}
+
+type ModelSource interface {
+	Name() string
+	models(text string) []string
+}
+
+type bundleScanSource struct{}
+
+func (bundleScanSource) Name() string { return "bundle-scan" }
+
+func (bundleScanSource) models(text string) []string {
+	return append(findGpt5Models(text), findCodexMaxVersions(text)...)
+}
+
+type defaultOrderSource struct{}
+
+func (defaultOrderSource) Name() string { return "default-order" }
+
+func (defaultOrderSource) models(text string) []string {
+	defaultOrder := parseDefaultOrder(text)
+	for i, item := range defaultOrder {
+		defaultOrder[i] = StripQuotes(item)
+	}
+	return defaultOrder
+}
+
+type staticSource struct {
+	label string
+	items []string
+}
+
+func (s staticSource) Name() string { return s.label }
+
+func (s staticSource) models(string) []string { return s.items }
+
+var BundleSources = []ModelSource{bundleScanSource{}, defaultOrderSource{}}
+
+func ModelProvenance(text string, sources []ModelSource) map[string][]string {
+	provenance := map[string][]string{}
+	for _, source := range sources {
+		for _, model := range source.models(text) {
+			key := NormalizeName(model)
+			labels := provenance[key]
+			if len(labels) == 0 || labels[len(labels)-1] != source.Name() {
+				provenance[key] = append(labels, source.Name())
+			}
+		}
+	}
+	return provenance
+}
+
+func CandidateModels(text string) []string {
+	candidates := map[string]struct{}{}
+	for _, source := range BundleSources {
+		for _, item := range source.models(text) {
+			if modelNamePattern.MatchString(item) {
+				candidates[item] = struct{}{}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates["gpt-5.1-codex-max"] = struct{}{}
+	}
+	models := make([]string, 0, len(candidates))
+	for item := range candidates {
+		models = append(models, item)
+	}
+	sort.Strings(models)
+	return models
+}
+
+func OptionSources(opts Options) []ModelSource {
+	return []ModelSource{
+		staticSource{label: "deprecation-kept", items: opts.ExtraModels},
+		staticSource{label: "add-model", items: opts.AddModels},
+		staticSource{label: "ensure-models", items: opts.EnsureModels},
+	}
+}
+
+type filterValue struct {
+	kind string
+	text string
+	flag bool
+}
+
+type ModelFilter struct {
+	Source string
+	eval   filterEval
+}
+
+func modelAttributes(model string) map[string]string {
+	name := NormalizeName(model)
+	attrs := map[string]string{"name": name, "family": name, "version": "", "variant": ""}
+	if match := regexp.MustCompile(`^([a-z]+)-([0-9]+(?:\.[0-9]+)*)(?:-(.+))?$`).FindStringSubmatch(name); match != nil {
+		attrs["family"] = match[1]
+		attrs["version"] = match[2]
+		attrs["variant"] = match[3]
+	}
+	return attrs
+}
+
+func (filter *ModelFilter) keep(model string) bool {
+	value, err := filter.eval(modelAttributes(model))
+	return err == nil && value.flag
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func ParseFilter(source string) (*ModelFilter, error) {
+	tokens, err := filterTokens(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	eval, err := parser.or()
+	if err == nil && parser.pos < len(tokens) {
+		err = fmt.Errorf("unexpected %s", tokens[parser.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", source, err.Error())
+	}
+	value, err := eval(modelAttributes("gpt-5.1-codex-max"))
+	if err == nil && value.kind != "bool" {
+		err = fmt.Errorf("expression yields a %s, not true or false", value.kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", source, err.Error())
+	}
+	return &ModelFilter{Source: source, eval: eval}, nil
+}
+
+func filterTokens(source string) ([]string, error) {
+	pattern := regexp.MustCompile(`^(\s+|&&|\|\||==|!=|<=|>=|[<>!(),]|"[^"]*"|'[^']*'|[0-9]+(?:\.[0-9]+)*|[A-Za-z_][A-Za-z0-9_]*)`)
+	tokens := []string{}
+	for rest := source; rest != ""; {
+		match := pattern.FindString(rest)
+		if match == "" {
+			return nil, fmt.Errorf("invalid filter %q: unexpected character %q", source, rest[:1])
+		}
+		if strings.TrimSpace(match) != "" {
+			tokens = append(tokens, match)
+		}
+		rest = rest[len(match):]
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) expect(token string) error {
+	if p.peek() != token {
+		if p.peek() == "" {
+			return fmt.Errorf("expected %q at end of expression", token)
+		}
+		return fmt.Errorf("expected %q, found %q", token, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+type filterEval func(attrs map[string]string) (filterValue, error)
+
+func (p *filterParser) or() (filterEval, error) {
+	return p.binary("||", p.and)
+}
+
+func (p *filterParser) and() (filterEval, error) {
+	return p.binary("&&", p.unary)
+}
+
+func (p *filterParser) binary(operator string, operand func() (filterEval, error)) (filterEval, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == operator {
+		p.pos++
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		first := left
+		left = func(attrs map[string]string) (filterValue, error) {
+			l, err := first(attrs)
+			if err != nil {
+				return l, err
+			}
+			r, err := right(attrs)
+			if err != nil {
+				return r, err
+			}
+			if l.kind != "bool" || r.kind != "bool" {
+				return filterValue{}, fmt.Errorf("%s needs true/false operands", operator)
+			}
+			if operator == "&&" {
+				return filterValue{kind: "bool", flag: l.flag && r.flag}, nil
+			}
+			return filterValue{kind: "bool", flag: l.flag || r.flag}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) unary() (filterEval, error) {
+	if p.peek() != "!" {
+		return p.comparison()
+	}
+	p.pos++
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(attrs map[string]string) (filterValue, error) {
+		value, err := operand(attrs)
+		if err == nil && value.kind != "bool" {
+			err = fmt.Errorf("! needs a true/false operand")
+		}
+		return filterValue{kind: "bool", flag: !value.flag}, err
+	}, nil
+}
+
+func (p *filterParser) comparison() (filterEval, error) {
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	operator := p.peek()
+	switch operator {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return left, nil
+	}
+	p.pos++
+	right, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return func(attrs map[string]string) (filterValue, error) {
+		l, err := left(attrs)
+		if err != nil {
+			return l, err
+		}
+		r, err := right(attrs)
+		if err != nil {
+			return r, err
+		}
+		var order int
+		switch {
+		case l.kind == "number" && r.kind == "number":
+			if l.text == "" || r.text == "" {
+				return filterValue{kind: "bool"}, nil
+			}
+			order = CompareVersions(l.text, r.text)
+		case l.kind == "string" && r.kind == "string":
+			order = strings.Compare(l.text, r.text)
+		case l.kind == "bool" && r.kind == "bool" && (operator == "==" || operator == "!="):
+			if l.flag != r.flag {
+				order = 1
+			}
+		default:
+			return filterValue{}, fmt.Errorf("cannot compare %s with %s using %s", l.kind, r.kind, operator)
+		}
+		result := map[string]bool{"==": order == 0, "!=": order != 0, "<": order < 0, "<=": order <= 0, ">": order > 0, ">=": order >= 0}[operator]
+		return filterValue{kind: "bool", flag: result}, nil
+	}, nil
+}
+
+var filterFunctions = map[string]func(text, argument string) (bool, error){
+	"contains":   func(text, argument string) (bool, error) { return strings.Contains(text, argument), nil },
+	"startsWith": func(text, argument string) (bool, error) { return strings.HasPrefix(text, argument), nil },
+	"endsWith":   func(text, argument string) (bool, error) { return strings.HasSuffix(text, argument), nil },
+	"matches":    func(text, argument string) (bool, error) { return regexp.MatchString(argument, text) },
+}
+
+func (p *filterParser) primary() (filterEval, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	switch {
+	case token == "(":
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case token == "true" || token == "false":
+		return func(map[string]string) (filterValue, error) {
+			return filterValue{kind: "bool", flag: token == "true"}, nil
+		}, nil
+	case strings.HasPrefix(token, `"`) || strings.HasPrefix(token, "'"):
+		text := token[1 : len(token)-1]
+		return func(map[string]string) (filterValue, error) {
+			return filterValue{kind: "string", text: text}, nil
+		}, nil
+	case token[0] >= '0' && token[0] <= '9':
+		return func(map[string]string) (filterValue, error) {
+			return filterValue{kind: "number", text: token}, nil
+		}, nil
+	case filterFunctions[token] != nil:
+		function := filterFunctions[token]
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		subject, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		argument, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(attrs map[string]string) (filterValue, error) {
+			s, err := subject(attrs)
+			if err != nil {
+				return s, err
+			}
+			a, err := argument(attrs)
+			if err != nil {
+				return a, err
+			}
+			if s.kind != "string" || a.kind != "string" {
+				return filterValue{}, fmt.Errorf("%s needs string arguments", token)
+			}
+			matched, err := function(s.text, a.text)
+			return filterValue{kind: "bool", flag: matched}, err
+		}, nil
+	case token == "name" || token == "family" || token == "variant":
+		return func(attrs map[string]string) (filterValue, error) {
+			return filterValue{kind: "string", text: attrs[token]}, nil
+		}, nil
+	case token == "version":
+		return func(attrs map[string]string) (filterValue, error) {
+			return filterValue{kind: "number", text: attrs["version"]}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown name %s (attributes: name, family, version, variant; functions: contains, startsWith, endsWith, matches)", token)
+}
+
+func ParseModelList(source, name string) ([]string, error) {
+	models := []string{}
+	for _, item := range strings.Split(source, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !modelNamePattern.MatchString(item) {
+			return nil, fmt.Errorf("%s: invalid model name %q", name, item)
+		}
+		models = append(models, item)
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("%s needs at least one model", name)
+	}
+	return models, nil
+}
+
+type ModelPattern struct {
+	Source string
+	negate bool
+	re     *regexp.Regexp
+}
+
+func ParseModelPattern(source string) (ModelPattern, error) {
+	pattern := ModelPattern{Source: source}
+	body := strings.TrimSpace(source)
+	if strings.HasPrefix(body, "!") {
+		pattern.negate = true
+		body = body[1:]
+	}
+	expr := ""
+	if len(body) >= 2 && strings.HasPrefix(body, "/") && strings.HasSuffix(body, "/") {
+		expr = "(?i)" + body[1:len(body)-1]
+	} else if body != "" {
+		glob := regexp.QuoteMeta(body)
+		glob = strings.ReplaceAll(glob, `\*`, ".*")
+		glob = strings.ReplaceAll(glob, `\?`, ".")
+		expr = "(?i)^" + glob + "$"
+	}
+	if expr == "" {
+		return pattern, fmt.Errorf("empty model pattern")
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return pattern, fmt.Errorf("invalid model pattern %q: %s", source, err.Error())
+	}
+	pattern.re = re
+	return pattern, nil
+}
+
+func (pattern ModelPattern) excludes(model string) bool {
+	return pattern.re.MatchString(NormalizeName(model)) != pattern.negate
+}
+
+func explicitModels(models []string) []string {
+	seen := map[string]struct{}{}
+	result := []string{}
+	for _, model := range models {
+		name := NormalizeName(model)
+		if _, ok := seen[name]; ok || name == "" {
+			continue
+		}
+		seen[name] = struct{}{}
+		result = append(result, quote(name))
+	}
+	return result
+}
+
+func BuildApikeyList(text string, opts Options) []string {
+	if opts.Models != nil {
+		return explicitModels(opts.Models)
+	}
+	candidates := map[string]struct{}{}
+	for _, item := range CandidateModels(text) {
+		candidates[item] = struct{}{}
+	}
+	for _, item := range opts.ExtraModels {
+		candidates[item] = struct{}{}
+	}
+	for _, item := range opts.AddModels {
+		candidates[item] = struct{}{}
+	}
+	for _, item := range opts.DropModels {
+		for candidate := range candidates {
+			if NormalizeName(candidate) == NormalizeName(item) {
+				delete(candidates, candidate)
+			}
+		}
+	}
+	if !opts.IncludeMini {
+		filtered := map[string]struct{}{}
+		for item := range candidates {
+			if !strings.Contains(strings.ToLower(item), "mini") {
+				filtered[item] = struct{}{}
+			}
+		}
+		candidates = filtered
+	}
+	if opts.Filter != nil {
+		for item := range candidates {
+			if !opts.Filter.keep(item) {
+				delete(candidates, item)
+			}
+		}
+	}
+	for _, pattern := range opts.ExcludeModels {
+		for item := range candidates {
+			if pattern.excludes(item) {
+				delete(candidates, item)
+			}
+		}
+	}
+	for _, item := range opts.EnsureModels {
+		present := false
+		for candidate := range candidates {
+			if NormalizeName(candidate) == NormalizeName(item) {
+				present = true
+			}
+		}
+		if !present {
+			candidates[item] = struct{}{}
+		}
+	}
+
+	models := make([]string, 0, len(candidates))
+	for item := range candidates {
+		models = append(models, item)
+	}
+	order := opts.Order
+	order.pinFirst = opts.PinFirst
+	return orderModels(models, order)
+}
+
+func codeMatches(text string, pattern *regexp.Regexp) [][]int {
+	matches := pattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return matches
+	}
+	spans, err := ScanJS(text)
+	if err != nil {
+		return matches
+	}
+	code := [][]int{}
+	k := 0
+	for _, match := range matches {
+		for k < len(spans) && spans[k].end <= match[0] {
+			k++
+		}
+		if k < len(spans) && spans[k].start <= match[0] {
+			continue
+		}
+		code = append(code, match)
+	}
+	return code
+}
+
+func replaceCode(text string, pattern *regexp.Regexp, replacement string) (string, bool) {
+	matches := codeMatches(text, pattern)
+	if len(matches) == 0 {
+		return text, false
+	}
+	var out strings.Builder
+	last := 0
+	for _, match := range matches {
+		out.WriteString(text[last:match[0]])
+		out.Write(pattern.ExpandString(nil, replacement, text, match))
+		last = match[1]
+	}
+	out.WriteString(text[last:])
+	return out.String(), true
+}
+
+func EnsuredAdditions(text string, opts Options) []string {
+	if len(opts.EnsureModels) == 0 || opts.Models != nil {
+		return nil
+	}
+	base := opts
+	base.EnsureModels = nil
+	computed := BuildApikeyList(UnpackText(text), base)
+	added := []string{}
+	for _, item := range opts.EnsureModels {
+		present := false
+		for _, model := range computed {
+			if NormalizeName(model) == NormalizeName(item) {
+				present = true
+			}
+		}
+		if !present {
+			added = append(added, item)
+		}
+	}
+	return added
+}
+
+func InjectedAdditions(text string, opts Options) []string {
+	if len(opts.AddModels) == 0 || opts.Models != nil {
+		return nil
+	}
+	unpacked := UnpackText(text)
+	known := map[string]bool{}
+	for _, model := range CandidateModels(unpacked) {
+		known[NormalizeName(model)] = true
+	}
+	kept := map[string]bool{}
+	for _, model := range BuildApikeyList(unpacked, opts) {
+		kept[NormalizeName(model)] = true
+	}
+	added := []string{}
+	for _, model := range opts.AddModels {
+		if name := NormalizeName(model); kept[name] && !known[name] {
+			added = append(added, name)
+			known[name] = true
+		}
+	}
+	return added
+}
+
+const spreadDedupe = ".filter((m,i,a)=>a.indexOf(m)===i)"
+
+var validArray = regexp.MustCompile(`^\[(?:(?:"[^"\\]*"|\.\.\.[A-Za-z_$][\w$.]*)(?:,(?:"[^"\\]*"|\.\.\.[A-Za-z_$][\w$.]*))*)?\]$`)
+
+func replaceSpreadArray(text string, pattern *regexp.Regexp, field string, newItems []string) (string, bool) {
+	matches := codeMatches(text, pattern)
+	if len(matches) == 0 {
+		return text, false
+	}
+	var out strings.Builder
+	last := 0
+	spread := false
+	for _, match := range matches {
+		spreads := []string{}
+		for _, item := range strings.Split(text[match[2]:match[3]], ",") {
+			if item = strings.TrimSpace(item); strings.HasPrefix(item, "...") {
+				spreads = append(spreads, item)
+			}
+		}
+		out.WriteString(text[last:match[0]])
+		last = match[1]
+		if len(spreads) == 0 {
+			out.WriteString(text[match[0]:match[1]])
+			continue
+		}
+		spread = true
+		out.WriteString(fmt.Sprintf("%s:[%s]", field, strings.Join(append(spreads, newItems...), ",")))
+		if !strings.HasPrefix(text[match[1]:], spreadDedupe) {
+			out.WriteString(spreadDedupe)
+		}
+	}
+	out.WriteString(text[last:])
+	return out.String(), spread
+}
+
+func replaceAuthMethodArray(text, field string, newItems []string) (string, bool) {
+	newArray := fmt.Sprintf("[%s]", strings.Join(newItems, ","))
+	newField := strings.ReplaceAll(fmt.Sprintf("%s:%s", field, newArray), "$", "$$")
+
+	patternArray := regexp.MustCompile(field + `:\s*\[([^\[\]]*)\]`)
+	if replaced, ok := replaceSpreadArray(text, patternArray, field, newItems); ok {
+		return replaced, replaced != text
+	}
+	if replaced, ok := replaceCode(text, patternArray, newField); ok {
+		return replaced, replaced != text
+	}
+
+	patternVar := regexp.MustCompile(field + `:[A-Z][A-Z0-9_]*`)
+	if replaced, ok := replaceCode(text, patternVar, newField); ok {
+		return replaced, replaced != text
+	}
+
+	return text, false
+}
+
+func ensureApikey(text string, opts Options) (string, bool) {
+	newList := BuildApikeyList(text, opts)
+	return replaceAuthMethodArray(text, "apikey", newList)
+}
+
+func ensureChatgpt(text string, opts Options) (string, bool) {
+	newList := BuildApikeyList(text, opts)
+	return replaceAuthMethodArray(text, "chatgpt", newList)
+}
+
+var planMapPattern = regexp.MustCompile(`\{\s*[A-Za-z_$][\w$]*:\s*\[[^\[\]{}]*\](?:\s*,\s*[A-Za-z_$][\w$]*:\s*\[[^\[\]{}]*\])+\s*,?\s*\}`)
+
+var planKeyPattern = regexp.MustCompile(`([{,]\s*)(plus|pro|team):\s*\[[^\[\]]*\]`)
+
+func PlanMaps(text string) [][]int {
+	maps := [][]int{}
+	for _, match := range codeMatches(text, planMapPattern) {
+		keys := map[string]bool{}
+		for _, key := range planKeyPattern.FindAllStringSubmatch(text[match[0]:match[1]], -1) {
+			keys[key[2]] = true
+		}
+		if len(keys) >= 2 {
+			maps = append(maps, match)
+		}
+	}
+	return maps
+}
+
+func ensurePlans(text string, opts Options) (string, bool) {
+	maps := PlanMaps(text)
+	if len(maps) != 1 {
+		return text, false
+	}
+	newList := strings.ReplaceAll(strings.Join(BuildApikeyList(text, opts), ","), "$", "$$")
+	start, end := maps[0][0], maps[0][1]
+	replaced := planKeyPattern.ReplaceAllString(text[start:end], "${1}${2}:["+newList+"]")
+	if replaced == text[start:end] {
+		return text, false
+	}
+	return text[:start] + replaced + text[end:], true
+}
+
+func removeAuthOnly(text string, keep []string) (string, bool) {
+	pattern := regexp.MustCompile(`CHAT_GPT_AUTH_ONLY_MODELS=new Set\(\[([^\[\]]*?)\]\)`)
+	matches := codeMatches(text, pattern)
+	if len(matches) == 0 {
+		return text, false
+	}
+	match := matches[0]
+	content := text[match[2]:match[3]]
+	if strings.TrimSpace(content) == "" {
+		return text, false
+	}
+	keepSet := map[string]struct{}{}
+	for _, item := range keep {
+		keepSet[NormalizeName(item)] = struct{}{}
+	}
+	kept := []string{}
+	for _, item := range strings.Split(content, ",") {
+		if _, ok := keepSet[NormalizeName(item)]; ok && StripQuotes(item) != "" {
+			kept = append(kept, strings.TrimSpace(item))
+		}
+	}
+	replacement := fmt.Sprintf("CHAT_GPT_AUTH_ONLY_MODELS=new Set([%s])", strings.Join(kept, ","))
+	if text[match[0]:match[1]] == replacement {
+		return text, false
+	}
+	return text[:match[0]] + replacement + text[match[1]:], true
+}
+
+type Options struct {
+	IncludeMini    bool
+	UnlockPlans    bool
+	Disabled       map[string]bool
+	AuthOnlyKeep   []string
+	Paranoid       bool
+	FromBackup     bool
+	ExtraModels    []string
+	DropModels     []string
+	ExcludeEditors []string
+	EnsureModels   []string
+	Models         []string
+	AddModels      []string
+	ExcludeModels  []ModelPattern
+	Order          ModelOrder
+	PinFirst       []string
+	Compressed     string
+	Filter         *ModelFilter
+	Allowlist      map[string]bool
+	DryRun         bool
+	Diff           bool
+}
+
+func (opts Options) RuleEnabled(rule string) bool {
+	return !opts.Disabled[rule]
+}
+
+func Trace(w io.Writer, source string, changes []string, opts Options) {
+	unpacked := UnpackText(source)
+	for _, pattern := range rulePatterns {
+		for _, match := range codeMatches(unpacked, pattern) {
+			snippet := unpacked[match[0]:match[1]]
+			if len(snippet) > 160 {
+				snippet = snippet[:160] + "…"
+			}
+			output.Debugf(w, "match at byte %d: %s\n", match[0], snippet)
+		}
+	}
+	models := []string{}
+	for _, model := range BuildApikeyList(unpacked, opts) {
+		models = append(models, StripQuotes(model))
+	}
+	output.Debugf(w, "computed model list: %s\n", strings.Join(models, ", "))
+	for _, rule := range Known {
+		decision := "already compliant"
+		switch {
+		case rule == "plans" && !opts.UnlockPlans:
+			decision = "skipped (needs --unlock-plans)"
+		case rule == "plans" && opts.RuleEnabled(rule) && len(PlanMaps(unpacked)) != 1:
+			decision = fmt.Sprintf("skipped (%d plan model maps found, need exactly one)", len(PlanMaps(unpacked)))
+		case !opts.RuleEnabled(rule):
+			decision = "disabled"
+		default:
+			for _, change := range changes {
+				if change == rule {
+					decision = "rewritten"
+				}
+			}
+		}
+		output.Debugf(w, "%s: %s\n", rule, decision)
+	}
+}
+
+func Apply(text string, opts Options) (string, []string) {
+	changedApikey := false
+	changedChatgpt := false
+	changedAuth := false
+	changedPlans := false
+
+	if opts.RuleEnabled("apikey") {
+		text, changedApikey = ensureApikey(text, opts)
+	}
+	if opts.RuleEnabled("chatgpt") {
+		text, changedChatgpt = ensureChatgpt(text, opts)
+	}
+	if opts.RuleEnabled("auth_only") {
+		text, changedAuth = removeAuthOnly(text, opts.AuthOnlyKeep)
+	}
+	if opts.UnlockPlans && opts.RuleEnabled("plans") {
+		text, changedPlans = ensurePlans(text, opts)
+	}
+	text, packedChanges := patchPacked(text, opts)
+
+	changes := []string{}
+	if changedApikey {
+		changes = append(changes, "apikey")
+	}
+	if changedChatgpt {
+		changes = append(changes, "chatgpt")
+	}
+	if changedAuth {
+		changes = append(changes, "auth_only")
+	}
+	if changedPlans {
+		changes = append(changes, "plans")
+	}
+	for _, change := range packedChanges {
+		found := false
+		for _, existing := range changes {
+			if existing == change {
+				found = true
+			}
+		}
+		if !found {
+			changes = append(changes, change)
+		}
+	}
+	return text, changes
+}
+
+func LiveChanges(text string, content []byte, changes []string) []string {
+	if len(changes) == 0 && text != string(content) {
+		return []string{"from_backup"}
+	}
+	if len(changes) > 0 && text == string(content) {
+		return nil
+	}
+	return changes
+}
+
+var packedPattern = regexp.MustCompile(`["'](?:data:[\w.+/-]+;base64,)?([A-Za-z0-9+/]{64,}={0,2})["']`)
+
+type packedSpan struct {
+	start, end int
+	decoded    string
+}
+
+func packedSpans(text string) []packedSpan {
+	spans := []packedSpan{}
+	for _, match := range packedPattern.FindAllStringSubmatchIndex(text, -1) {
+		decoded, err := base64.StdEncoding.DecodeString(text[match[2]:match[3]])
+		if err != nil || !utf8.Valid(decoded) {
+			continue
+		}
+		if len(MissingAnchors(string(decoded))) == 3 && !strings.Contains(string(decoded), "DEFAULT_MODEL_ORDER") {
+			continue
+		}
+		spans = append(spans, packedSpan{start: match[2], end: match[3], decoded: string(decoded)})
+	}
+	return spans
+}
+
+func patchPacked(text string, opts Options) (string, []string) {
+	spans := packedSpans(text)
+	changes := []string{}
+	for i := len(spans) - 1; i >= 0; i-- {
+		patched, inner := Apply(spans[i].decoded, opts)
+		if len(inner) == 0 {
+			continue
+		}
+		text = text[:spans[i].start] + base64.StdEncoding.EncodeToString([]byte(patched)) + text[spans[i].end:]
+		changes = append(changes, inner...)
+	}
+	return text, changes
+}
+
+func UnpackText(text string) string {
+	for _, span := range packedSpans(text) {
+		text += "\n" + UnpackText(span.decoded)
+	}
+	return text
+}
+
+type jsSpan struct {
+	start int
+	end   int
+}
+
+var regexKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true, "new": true,
+	"delete": true, "void": true, "throw": true, "case": true, "do": true, "else": true,
+	"yield": true, "await": true,
+}
+
+func isIdentByte(ch byte) bool {
+	return ch == '_' || ch == '$' || ch >= 0x80 || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+func scanTemplate(text string, start int) (int, bool, error) {
+	for j := start; j < len(text); j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '`':
+			return j, false, nil
+		case '$':
+			if j+1 < len(text) && text[j+1] == '{' {
+				return j + 1, true, nil
+			}
+		}
+	}
+	return 0, false, fmt.Errorf("unterminated template literal at offset %d", start-1)
+}
+
+func ScanJS(text string) ([]jsSpan, error) {
+	spans := []jsSpan{}
+	stack := []byte{}
+	last := byte(0)
+	lastWord := ""
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			continue
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for ; j < len(text) && text[j] != ch; j++ {
+				if text[j] == '\\' {
+					j++
+				} else if text[j] == '\n' {
+					return spans, fmt.Errorf("unterminated string at offset %d", i)
+				}
+			}
+			if j >= len(text) {
+				return spans, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			spans = append(spans, jsSpan{i, j + 1})
+			i = j
+			last, lastWord = '"', ""
+		case ch == '`':
+			end, interpolation, err := scanTemplate(text, i+1)
+			if err != nil {
+				return spans, err
+			}
+			spans = append(spans, jsSpan{i, end + 1})
+			if interpolation {
+				stack = append(stack, '`')
+				last = '{'
+			} else {
+				last = '"'
+			}
+			i, lastWord = end, ""
+		case ch == '/' && i+1 < len(text) && text[i+1] == '/':
+			end := strings.IndexByte(text[i:], '\n')
+			if end < 0 {
+				end = len(text) - i
+			}
+			spans = append(spans, jsSpan{i, i + end})
+			i += end
+		case ch == '/' && i+1 < len(text) && text[i+1] == '*':
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				return spans, fmt.Errorf("unterminated comment at offset %d", i)
+			}
+			spans = append(spans, jsSpan{i, i + end + 4})
+			i += end + 3
+		case ch == '/' && (last == 0 || strings.IndexByte("(,=:[!&|?{};+-*%<>~^", last) >= 0 || (last == 'a' && regexKeywords[lastWord])):
+			j := i + 1
+			inClass := false
+			for ; j < len(text); j++ {
+				if text[j] == '\\' {
+					j++
+				} else if text[j] == '\n' {
+					return spans, fmt.Errorf("unterminated regular expression at offset %d", i)
+				} else if text[j] == '[' {
+					inClass = true
+				} else if text[j] == ']' {
+					inClass = false
+				} else if text[j] == '/' && !inClass {
+					break
+				}
+			}
+			if j >= len(text) {
+				return spans, fmt.Errorf("unterminated regular expression at offset %d", i)
+			}
+			spans = append(spans, jsSpan{i, j + 1})
+			i = j
+			last, lastWord = '"', ""
+		case ch == '(' || ch == '[' || ch == '{':
+			stack = append(stack, ch)
+			last, lastWord = ch, ""
+		case ch == ')' || ch == ']' || ch == '}':
+			open := map[byte]byte{')': '(', ']': '[', '}': '{'}[ch]
+			if len(stack) == 0 {
+				return spans, fmt.Errorf("unexpected %c at offset %d", ch, i)
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if ch == '}' && top == '`' {
+				end, interpolation, err := scanTemplate(text, i+1)
+				if err != nil {
+					return spans, err
+				}
+				spans = append(spans, jsSpan{i, end + 1})
+				if interpolation {
+					stack = append(stack, '`')
+					last = '{'
+				} else {
+					last = '"'
+				}
+				i, lastWord = end, ""
+				continue
+			}
+			if top != open {
+				return spans, fmt.Errorf("mismatched %c at offset %d", ch, i)
+			}
+			last, lastWord = ch, ""
+		case isIdentByte(ch):
+			j := i
+			for j < len(text) && isIdentByte(text[j]) {
+				j++
+			}
+			last, lastWord = 'a', text[i:j]
+			i = j - 1
+		default:
+			last, lastWord = ch, ""
+		}
+	}
+	if len(stack) > 0 {
+		return spans, fmt.Errorf("unclosed %c at end of file", stack[len(stack)-1])
+	}
+	return spans, nil
+}
+
+func CheckSyntax(original, patched string) error {
+	if _, err := ScanJS(original); err == nil {
+		_, err := ScanJS(patched)
+		return err
+	}
+	for _, pattern := range rulePatterns {
+		for _, match := range pattern.FindAllString(patched, -1) {
+			start := strings.Index(match, "[")
+			end := strings.LastIndex(match, "]")
+			if start < 0 || end < start {
+				continue
+			}
+			if _, err := ScanJS(match[start : end+1]); err != nil {
+				return fmt.Errorf("%s in %s", err.Error(), match)
+			}
+		}
+	}
+	return nil
+}
+
+var rulePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(apikey|chatgpt):(\s*\[[^\[\]]*\](?:\.filter\(\(m,i,a\)=>a\.indexOf\(m\)===i\))?|[A-Z][A-Z0-9_]*)`),
+	regexp.MustCompile(`CHAT_GPT_AUTH_ONLY_MODELS=new Set\(\[[^\[\]]*?\]\)`),
+	planKeyPattern,
+}
+
+func ruleSkeleton(text string) string {
+	spans := packedSpans(text)
+	for i := len(spans) - 1; i >= 0; i-- {
+		text = text[:spans[i].start] + "\x01" + ruleSkeleton(spans[i].decoded) + "\x01" + text[spans[i].end:]
+	}
+	for _, pattern := range rulePatterns {
+		text = pattern.ReplaceAllString(text, "\x00")
+	}
+	return text
+}
+
+func CheckInvariants(original, patched string, opts Options) error {
+	if ruleSkeleton(original) != ruleSkeleton(patched) {
+		return fmt.Errorf("bytes outside the replaced spans changed")
+	}
+	if again, _ := Apply(patched, opts); again != patched {
+		return fmt.Errorf("replacement is not idempotent")
+	}
+	valid := validArray
+	unpacked := UnpackText(patched)
+	arrays := [][]string{}
+	for _, match := range codeMatches(unpacked, regexp.MustCompile(`(?:apikey|chatgpt):\s*(\[[^\[\]]*\])`)) {
+		arrays = append(arrays, []string{unpacked[match[0]:match[1]], unpacked[match[2]:match[3]]})
+	}
+	if maps := PlanMaps(unpacked); opts.UnlockPlans && opts.RuleEnabled("plans") && len(maps) == 1 {
+		planMap := unpacked[maps[0][0]:maps[0][1]]
+		for _, match := range planKeyPattern.FindAllStringSubmatchIndex(planMap, -1) {
+			field := planMap[match[0]:match[1]]
+			arrays = append(arrays, []string{field, field[strings.Index(field, "["):]})
+		}
+	}
+	for _, array := range arrays {
+		if !valid.MatchString(array[1]) {
+			return fmt.Errorf("not a valid string array: %s", array[0])
+		}
+		seen := map[string]struct{}{}
+		for _, item := range splitQuotedList(strings.Trim(array[1], "[]")) {
+			if _, ok := seen[item]; ok {
+				return fmt.Errorf("duplicate entry %s in %s", item, array[0])
+			}
+			seen[item] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func ModelSetDiff(previous, current []string) (added, removed []string) {
+	before := map[string]struct{}{}
+	for _, model := range previous {
+		before[NormalizeName(model)] = struct{}{}
+	}
+	after := map[string]struct{}{}
+	for _, model := range current {
+		after[NormalizeName(model)] = struct{}{}
+		if _, ok := before[NormalizeName(model)]; !ok {
+			added = append(added, model)
+		}
+	}
+	for _, model := range previous {
+		if _, ok := after[NormalizeName(model)]; !ok {
+			removed = append(removed, model)
+		}
+	}
+	return added, removed
+}
+
+func VerifyWritten(filePath, expected string, changes []string, opts Options) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	text := string(content)
+	if text != expected {
+		return fmt.Errorf("content on disk differs from what was written")
+	}
+	if again, _ := Apply(text, opts); again != text {
+		return fmt.Errorf("rules do not converge on re-read content")
+	}
+	valid := validArray
+	for _, field := range changes {
+		if field != "apikey" && field != "chatgpt" {
+			continue
+		}
+		unpacked := UnpackText(text)
+		matches := codeMatches(unpacked, regexp.MustCompile(field+`:\s*\[[^\[\]]*\]`))
+		if len(matches) == 0 {
+			return fmt.Errorf("%s array missing after write", field)
+		}
+		for _, match := range matches {
+			array := unpacked[match[0]:match[1]]
+			value := strings.TrimSpace(array[strings.Index(array, ":")+1:])
+			if !valid.MatchString(value) {
+				return fmt.Errorf("%s array is not a valid string array: %s", field, value)
+			}
+		}
+	}
+	return nil
+}
+
+type BundleArrays struct {
+	Path         string              `json:"path"`
+	Arrays       map[string][]string `json:"arrays"`
+	References   map[string]string   `json:"references,omitempty"`
+	AuthOnly     []string            `json:"auth_only"`
+	DefaultOrder []string            `json:"default_model_order"`
+	Provenance   map[string][]string `json:"provenance,omitempty"`
+}
+
+func splitQuotedList(content string) []string {
+	items := []string{}
+	for _, item := range strings.Split(content, ",") {
+		if value := StripQuotes(item); value != "" && !strings.HasPrefix(value, "...") {
+			items = append(items, value)
+		}
+	}
+	return items
+}
+
+func ExtractArrays(filePath, text string) BundleArrays {
+	text = UnpackText(text)
+	result := BundleArrays{
+		Path:         filePath,
+		Arrays:       map[string][]string{},
+		References:   map[string]string{},
+		AuthOnly:     []string{},
+		DefaultOrder: splitQuotedList(strings.Join(parseDefaultOrder(text), ",")),
+	}
+	for _, field := range []string{"apikey", "chatgpt", "plus", "pro", "team"} {
+		if matches := codeMatches(text, regexp.MustCompile(`\b`+field+`:\s*\[([^\[\]]*)\]`)); len(matches) > 0 {
+			result.Arrays[field] = splitQuotedList(text[matches[0][2]:matches[0][3]])
+		} else if matches := codeMatches(text, regexp.MustCompile(`\b`+field+`:([A-Z][A-Z0-9_]*)`)); len(matches) > 0 {
+			result.References[field] = text[matches[0][2]:matches[0][3]]
+		}
+	}
+	if matches := codeMatches(text, regexp.MustCompile(`CHAT_GPT_AUTH_ONLY_MODELS=new Set\(\[([^\[\]]*?)\]\)`)); len(matches) > 0 {
+		result.AuthOnly = splitQuotedList(text[matches[0][2]:matches[0][3]])
+	}
+	return result
+}
+
+var Descriptions = map[string]string{
+	"apikey":           "apikey model list is not patched",
+	"chatgpt":          "chatgpt (OAuth) model list is not patched",
+	"auth_only":        "CHAT_GPT_AUTH_ONLY_MODELS still gates models",
+	"plans":            "plan model maps are not patched",
+	"missing-anchor":   "bundle no longer contains an anchor the rules rely on",
+	"deprecated-model": "a previously patched model is no longer advertised upstream",
+}
+
+func CompareVersions(left, right string) int {
+	leftParts := strings.Split(left, ".")
+	rightParts := strings.Split(right, ".")
+	max := len(leftParts)
+	if len(rightParts) > max {
+		max = len(rightParts)
+	}
+	for i := 0; i < max; i++ {
+		var l, r int
+		if i < len(leftParts) {
+			l, _ = strconv.Atoi(leftParts[i])
+		}
+		if i < len(rightParts) {
+			r, _ = strconv.Atoi(rightParts[i])
+		}
+		if l != r {
+			if l < r {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func MissingAnchors(text string) []string {
+	missing := []string{}
+	for _, field := range []string{"apikey", "chatgpt"} {
+		if !regexp.MustCompile(field + `:(\s*\[[^\[\]]*\]|[A-Z][A-Z0-9_]*)`).MatchString(text) {
+			missing = append(missing, field)
+		}
+	}
+	if !strings.Contains(text, "CHAT_GPT_AUTH_ONLY_MODELS=new Set([") {
+		missing = append(missing, "auth_only")
+	}
+	return missing
+}
+
+var Known = []string{"apikey", "chatgpt", "auth_only", "plans"}
+
+func versionParts(version string) []int {
+	parts := strings.Split(strings.Split(version, "-")[1], ".")
+	result := make([]int, 0, len(parts))
+	for _, part := range parts {
+		value, _ := strconv.Atoi(part)
+		result = append(result, value)
+	}
+	return result
+}
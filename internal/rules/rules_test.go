@@ -0,0 +1,161 @@
+package rules
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var fixtureModels = []string{
+	"gpt-5", "gpt-5-codex", "gpt-5-pro", "gpt-5-codex-mini", "gpt-5-1", "gpt-5.1",
+	"gpt-5.1-codex", "gpt-5.1-codex-max", "gpt-5.1-codex-mini", "gpt-5.2", "gpt-5.2-codex-max",
+}
+
+var fixtureFillers = []string{
+	"var a=1;", "function f(){return 2}", "const s=\"apikey\";", "/* chatgpt:[] */", "let o={x:[1,2]};",
+	"\n", "if(a){b()}", "const t=`gpt-5.3`;", "x=[\"y\"];",
+}
+
+func pickModels(r *rand.Rand, max int) []string {
+	models := []string{}
+	for i := r.Intn(max + 1); i > 0; i-- {
+		models = append(models, fmt.Sprintf("%q", fixtureModels[r.Intn(len(fixtureModels))]))
+	}
+	return models
+}
+
+func filler(r *rand.Rand) string {
+	var out strings.Builder
+	for i := r.Intn(4); i > 0; i-- {
+		out.WriteString(fixtureFillers[r.Intn(len(fixtureFillers))])
+	}
+	return out.String()
+}
+
+func randomBundle(r *rand.Rand) string {
+	var out strings.Builder
+	out.WriteString(filler(r))
+	out.WriteString("const DEFAULT_MODEL_ORDER=[" + strings.Join(pickModels(r, 5), ",") + "],")
+	chatgpt := "DEFAULT_MODELS"
+	if r.Intn(2) == 0 {
+		chatgpt = "[" + strings.Join(pickModels(r, 4), ",") + "]"
+	}
+	out.WriteString("M={apikey:[" + strings.Join(pickModels(r, 4), ",") + "],chatgpt:" + chatgpt + "}")
+	if r.Intn(2) == 0 {
+		out.WriteString(",P={plus:[" + strings.Join(pickModels(r, 3), ",") + "],pro:[" + strings.Join(pickModels(r, 3), ",") + "],team:[]}")
+	}
+	out.WriteString(";")
+	out.WriteString(filler(r))
+	if r.Intn(2) == 0 {
+		out.WriteString("var CHAT_GPT_AUTH_ONLY_MODELS=new Set([" + strings.Join(pickModels(r, 3), ",") + "]);")
+	}
+	out.WriteString(filler(r))
+	return out.String()
+}
+
+func randomOptions(r *rand.Rand) Options {
+	opts := Options{Disabled: map[string]bool{}}
+	opts.IncludeMini = r.Intn(2) == 0
+	opts.UnlockPlans = r.Intn(2) == 0
+	return opts
+}
+
+var arrayField = regexp.MustCompile(`(apikey|chatgpt|plus|pro|team):(\[[^\]]*\])`)
+
+func TestApplyRulesProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		original := randomBundle(r)
+		opts := randomOptions(r)
+		patched, _ := Apply(original, opts)
+		for _, match := range arrayField.FindAllStringSubmatch(patched, -1) {
+			if match[1] != "apikey" && match[1] != "chatgpt" && !opts.UnlockPlans {
+				continue
+			}
+			if !validArray.MatchString(match[2]) {
+				t.Fatalf("case %d: %s is not a valid string array\n%s", i, match[0], original)
+			}
+			seen := map[string]bool{}
+			for _, item := range splitQuotedList(strings.Trim(match[2], "[]")) {
+				if seen[item] {
+					t.Fatalf("case %d: duplicate %s in %s", i, item, match[0])
+				}
+				seen[item] = true
+			}
+		}
+		if ruleSkeleton(original) != ruleSkeleton(patched) {
+			t.Fatalf("case %d: bytes outside the replaced spans changed\nbefore: %s\nafter:  %s", i, original, patched)
+		}
+		if again, changes := Apply(patched, opts); again != patched || len(changes) != 0 {
+			t.Fatalf("case %d: second run changed %v\n%s", i, changes, patched)
+		}
+		if err := CheckInvariants(original, patched, opts); err != nil {
+			t.Fatalf("case %d: %s\n%s", i, err, patched)
+		}
+	}
+}
+
+func TestApplyRulesPreservesUnrelatedBytes(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		head, tail := filler(r), filler(r)
+		core := "M={apikey:[" + strings.Join(pickModels(r, 4), ",") + "],chatgpt:DEFAULT_MODELS};"
+		patched, _ := Apply(head+core+tail, randomOptions(r))
+		if !strings.HasPrefix(patched, head) || !strings.HasSuffix(patched, tail) {
+			t.Fatalf("case %d: surrounding bytes changed\nbefore: %s\nafter:  %s", i, head+core+tail, patched)
+		}
+	}
+}
+
+func FuzzApplyRules(f *testing.F) {
+	f.Add(`const DEFAULT_MODEL_ORDER=["gpt-5.1-codex-max","gpt-5.1"],M={apikey:["gpt-5"],chatgpt:DEFAULT_MODELS};`)
+	f.Add(`M={apikey:[...BASE,"gpt-5"],chatgpt:[]};var CHAT_GPT_AUTH_ONLY_MODELS=new Set(["gpt-5-pro"]);`)
+	f.Add(`P={plus:["gpt-5"],pro:[],team:["gpt-5-codex"]};const s="apikey:[1]";`)
+	f.Add(`apikey:[chatgpt:A0`)
+	f.Add(`DEFAULT_MODEL_ORDER=[apikey:A00`)
+	f.Add(`,team:[apikey:A00`)
+	f.Add(`zYnbc*DEFAULT_MODEL_ORDER=["gpt-5.1-codex-max2,"gpt-5$0"]000000000000000000000chatgpt:A000000000000000`)
+	f.Fuzz(func(t *testing.T, original string) {
+		opts := Options{Disabled: map[string]bool{}, Compressed: "regenerate", UnlockPlans: true}
+		patched, changes := Apply(original, opts)
+		if len(changes) == 0 {
+			return
+		}
+		if ruleSkeleton(original) != ruleSkeleton(patched) {
+			t.Fatalf("bytes outside the replaced spans changed\nbefore: %q\nafter:  %q", original, patched)
+		}
+		if again, _ := Apply(patched, opts); again != patched {
+			t.Fatalf("not idempotent\nfirst:  %q\nsecond: %q", patched, again)
+		}
+	})
+}
+
+func TestEnsurePlansNeedsExactlyOnePlanMap(t *testing.T) {
+	plans := `P={plus:["gpt-5"],pro:["gpt-5","gpt-5-pro"],team:[]}`
+	cases := []struct {
+		name    string
+		text    string
+		changed bool
+	}{
+		{"single map", "const DEFAULT_MODEL_ORDER=[\"gpt-5.1\"];" + plans + ";", true},
+		{"unrelated pro key", `const DEFAULT_MODEL_ORDER=["gpt-5.1"];` + plans + `;const price={pro:[20],label:"Pro"};`, true},
+		{"no map", `const DEFAULT_MODEL_ORDER=["gpt-5.1"];const tiers={pro:["a"]};`, false},
+		{"pricing table too", `const DEFAULT_MODEL_ORDER=["gpt-5.1"];` + plans + `;const price={plus:[20],pro:[200]};`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			patched, changed := ensurePlans(c.text, Options{})
+			if changed != c.changed {
+				t.Fatalf("changed = %v, want %v\n%s", changed, c.changed, patched)
+			}
+			if !changed && patched != c.text {
+				t.Fatalf("text changed although the rule reported no change")
+			}
+			if changed && !strings.Contains(patched, `const price={pro:[20],label:"Pro"}`) && strings.Contains(c.text, "const price") {
+				t.Fatalf("unrelated object rewritten: %s", patched)
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+// Package sinks records run events: the event sinks, the manifest, the state
+// file, run statistics and the metrics endpoint.
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huangang/codex-autopatch/internal/discovery"
+	"github.com/huangang/codex-autopatch/internal/output"
+)
+
+type TargetResult struct {
+	Out      bytes.Buffer
+	Result   string
+	Hash     string
+	Drifted  bool
+	Duration time.Duration
+}
+
+type TargetState struct {
+	Result        string  `json:"result"`
+	Hash          string  `json:"sha256"`
+	UpdatedAt     string  `json:"updated_at"`
+	Host          string  `json:"host,omitempty"`
+	OS            string  `json:"os,omitempty"`
+	Editor        string  `json:"editor,omitempty"`
+	Source        string  `json:"source,omitempty"`
+	BackupVersion string  `json:"backup_version,omitempty"`
+	GoodHash      string  `json:"last_known_good,omitempty"`
+	GoodAt        string  `json:"last_known_good_at,omitempty"`
+	DurationMS    float64 `json:"duration_ms,omitempty"`
+}
+
+func HostName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+type RunState struct {
+	Targets  map[string]TargetState    `json:"targets"`
+	Models   map[string][]string       `json:"models,omitempty"`
+	Upstream map[string]UpstreamModels `json:"upstream,omitempty"`
+	Counters runCounters               `json:"counters"`
+}
+
+type runCounters struct {
+	Runs        int64  `json:"runs"`
+	Patched     int64  `json:"patched"`
+	Failed      int64  `json:"failed"`
+	Drift       int64  `json:"drift"`
+	LastSuccess string `json:"last_success,omitempty"`
+}
+
+type UpstreamModels struct {
+	Version string   `json:"version,omitempty"`
+	Models  []string `json:"models"`
+}
+
+func LoadState() RunState {
+	state := RunState{Targets: map[string]TargetState{}, Models: map[string][]string{}, Upstream: map[string]UpstreamModels{}}
+	content, err := os.ReadFile(discovery.StatePath())
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(content, &state); err != nil || state.Targets == nil {
+		return RunState{Targets: map[string]TargetState{}, Models: map[string][]string{}, Upstream: map[string]UpstreamModels{}}
+	}
+	if state.Models == nil {
+		state.Models = map[string][]string{}
+	}
+	if state.Upstream == nil {
+		state.Upstream = map[string]UpstreamModels{}
+	}
+	return state
+}
+
+func SaveState(state RunState) {
+	if discovery.StatePath() == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(discovery.StatePath()), 0o755); err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return
+	}
+	encoded, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+		return
+	}
+	if err := os.WriteFile(discovery.StatePath(), encoded, 0o644); err != nil {
+		output.Logf("[error]   %s\n", err.Error())
+	}
+}
+
+type runEvent struct {
+	Time   string `json:"time"`
+	Host   string `json:"host"`
+	Action string `json:"action"`
+	Path   string `json:"path,omitempty"`
+	Editor string `json:"editor,omitempty"`
+	Hash   string `json:"sha256,omitempty"`
+	Backup string `json:"backup,omitempty"`
+}
+
+const (
+	EventDiscovered = "discovered"
+	EventBackup     = "backup"
+	EventPatched    = "patched"
+	eventCompliant  = "compliant"
+	eventFailed     = "failed"
+	EventRestored   = "restored"
+	EventUndone     = "undone"
+	EventCompleted  = "completed"
+)
+
+var (
+	eventMu     sync.Mutex
+	subscribers = []func(runEvent){forwardToSinks, appendManifest}
+)
+
+func Publish(action, target, backup string) {
+	event := runEvent{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Host:   HostName(),
+		Action: action,
+		Backup: backup,
+	}
+	if target != "" {
+		event.Path = discovery.StateKey(target)
+		event.Editor = discovery.EditorForPath(target)
+		if content, err := os.ReadFile(target); err == nil {
+			event.Hash = discovery.SHA256Hex(content)
+		}
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+}
+
+type sink interface {
+	report(event runEvent) error
+	close() error
+}
+
+type jsonlSink struct {
+	file *os.File
+}
+
+func (s *jsonlSink) report(event runEvent) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(encoded, '\n'))
+	return err
+}
+
+func (s *jsonlSink) close() error {
+	return s.file.Close()
+}
+
+type webhookSink struct {
+	url    string
+	events []runEvent
+}
+
+func (s *webhookSink) report(event runEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *webhookSink) close() error {
+	if len(s.events) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(s.events)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(s.url, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+type syslogSink struct {
+	conn net.Conn
+	tag  string
+}
+
+func (s *syslogSink) report(event runEvent) error {
+	priority := 14
+	if event.Action == eventFailed {
+		priority = 11
+	}
+	_, err := fmt.Fprintf(s.conn, "<%d>%s: %s %s", priority, s.tag, event.Action, event.Path)
+	return err
+}
+
+func (s *syslogSink) close() error {
+	return s.conn.Close()
+}
+
+var Active []sink
+
+func Open(configs map[string]Config) error {
+	names := []string{}
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg := configs[name]
+		switch name {
+		case "jsonl":
+			target := cfg.Path
+			if strings.HasPrefix(target, "~/") {
+				target = discovery.HomePath(target[2:])
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				return err
+			}
+			Active = append(Active, &jsonlSink{file: file})
+		case "webhook":
+			Active = append(Active, &webhookSink{url: cfg.URL})
+		case "syslog":
+			socket := cfg.Path
+			if socket == "" {
+				socket = "/dev/log"
+				if runtime.GOOS == "darwin" {
+					socket = "/var/run/syslog"
+				}
+			}
+			conn, err := net.Dial("unixgram", socket)
+			if err != nil {
+				return fmt.Errorf("syslog: %s", err.Error())
+			}
+			tag := cfg.Tag
+			if tag == "" {
+				tag = "codex-autopatch"
+			}
+			Active = append(Active, &syslogSink{conn: conn, tag: tag})
+		}
+	}
+	return nil
+}
+
+func forwardToSinks(event runEvent) {
+	for _, s := range Active {
+		if err := s.report(event); err != nil {
+			output.Logf("[error]   sink: %s\n", err.Error())
+		}
+	}
+}
+
+func Close() {
+	for _, s := range Active {
+		if err := s.close(); err != nil {
+			output.Logf("[error]   sink: %s\n", err.Error())
+		}
+	}
+	Active = nil
+}
+
+type manifestRecord struct {
+	Time   string `json:"time"`
+	Host   string `json:"host"`
+	User   string `json:"user,omitempty"`
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Hash   string `json:"sha256,omitempty"`
+	Backup string `json:"backup,omitempty"`
+}
+
+var (
+	manifestFile string
+	manifestMu   sync.Mutex
+)
+
+// SetManifest points the audit manifest at path; an empty path turns it off.
+func SetManifest(path string) {
+	manifestFile = path
+}
+
+func DefaultManifestPath() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			return ""
+		}
+		return filepath.Join(programData, "codex-autopatch", "manifest.jsonl")
+	}
+	if os.Geteuid() != 0 {
+		return ""
+	}
+	return "/var/lib/codex-autopatch/manifest.jsonl"
+}
+
+func appendManifest(event runEvent) {
+	if manifestFile == "" || (event.Action != EventPatched && event.Action != EventRestored && event.Action != EventUndone) {
+		return
+	}
+	record := manifestRecord{
+		Time:   event.Time,
+		Host:   event.Host,
+		Action: event.Action,
+		Path:   event.Path,
+		Backup: event.Backup,
+		Hash:   event.Hash,
+	}
+	if account, err := user.Current(); err == nil {
+		record.User = account.Username
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(manifestFile), 0o755); err != nil {
+		output.Logf("[error]   manifest: %s\n", err.Error())
+		return
+	}
+	file, err := os.OpenFile(manifestFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		output.Logf("[error]   manifest: %s\n", err.Error())
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(encoded, '\n')); err != nil {
+		output.Logf("[error]   manifest: %s\n", err.Error())
+	}
+}
+
+type Config struct {
+	Path string
+	URL  string
+	Tag  string
+}
+
+type runStats struct {
+	Hosts        []string           `json:"hosts"`
+	Users        []string           `json:"users"`
+	Targets      int                `json:"targets"`
+	Patched      int                `json:"patched"`
+	Compliant    int                `json:"compliant"`
+	Failed       int                `json:"failed"`
+	Drifted      int                `json:"drifted"`
+	BytesWritten int64              `json:"bytes_written"`
+	DurationMS   map[string]float64 `json:"duration_ms"`
+	ElapsedMS    float64            `json:"elapsed_ms"`
+}
+
+func BuildStats(targets []string, results []TargetResult, elapsed time.Duration) runStats {
+	stats := runStats{Hosts: []string{HostName()}, Users: []string{}, Targets: len(targets), DurationMS: map[string]float64{}}
+	if account, err := user.Current(); err == nil {
+		stats.Users = append(stats.Users, account.Username)
+	}
+	durations := []float64{}
+	for i, result := range results {
+		switch result.Result {
+		case "patched":
+			stats.Patched++
+			if info, err := os.Stat(targets[i]); err == nil {
+				stats.BytesWritten += info.Size()
+			}
+		case "compliant":
+			stats.Compliant++
+		case "failed":
+			stats.Failed++
+		}
+		if result.Drifted {
+			stats.Drifted++
+		}
+		durations = append(durations, float64(result.Duration.Microseconds())/1000)
+	}
+	sort.Float64s(durations)
+	for _, p := range []int{50, 90, 99, 100} {
+		name := fmt.Sprintf("p%d", p)
+		if p == 100 {
+			name = "max"
+		}
+		if len(durations) == 0 {
+			stats.DurationMS[name] = 0
+			continue
+		}
+		rank := (len(durations)*p+99)/100 - 1
+		if rank < 0 {
+			rank = 0
+		}
+		stats.DurationMS[name] = durations[rank]
+	}
+	stats.ElapsedMS = float64(elapsed.Microseconds()) / 1000
+	return stats
+}
+
+func CountDrift(events int) {
+	state := LoadState()
+	state.Counters.Drift += int64(events)
+	SaveState(state)
+}
+
+func promLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func renderMetrics(state RunState) string {
+	var out strings.Builder
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(&out, "# HELP codex_autopatch_%s %s\n# TYPE codex_autopatch_%s counter\ncodex_autopatch_%s %d\n", name, help, name, name, value)
+	}
+	counter("runs_total", "Patch runs completed.", state.Counters.Runs)
+	counter("patches_applied_total", "Bundles rewritten with the patched model lists.", state.Counters.Patched)
+	counter("failures_total", "Bundles whose patch or post-write verification failed.", state.Counters.Failed)
+	counter("drift_events_total", "Bundles found changed after they were patched.", state.Counters.Drift)
+	if success, err := time.Parse(time.RFC3339, state.Counters.LastSuccess); err == nil {
+		fmt.Fprintf(&out, "# HELP codex_autopatch_last_success_timestamp_seconds End of the last run without failures.\n# TYPE codex_autopatch_last_success_timestamp_seconds gauge\ncodex_autopatch_last_success_timestamp_seconds %d\n", success.Unix())
+	}
+	keys := make([]string, 0, len(state.Targets))
+	for key := range state.Targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out.WriteString("# HELP codex_autopatch_target_result Last result per bundle (1 for the current result).\n# TYPE codex_autopatch_target_result gauge\n")
+	for _, key := range keys {
+		target := state.Targets[key]
+		fmt.Fprintf(&out, "codex_autopatch_target_result{path=\"%s\",editor=\"%s\",result=\"%s\"} 1\n", promLabel(key), promLabel(target.Editor), promLabel(target.Result))
+	}
+	out.WriteString("# HELP codex_autopatch_target_duration_seconds Time the last run spent on each bundle.\n# TYPE codex_autopatch_target_duration_seconds gauge\n")
+	for _, key := range keys {
+		target := state.Targets[key]
+		fmt.Fprintf(&out, "codex_autopatch_target_duration_seconds{path=\"%s\",editor=\"%s\"} %g\n", promLabel(key), promLabel(target.Editor), target.DurationMS/1000)
+	}
+	out.WriteString("# HELP codex_autopatch_target_updated_timestamp_seconds When each bundle was last checked.\n# TYPE codex_autopatch_target_updated_timestamp_seconds gauge\n")
+	for _, key := range keys {
+		target := state.Targets[key]
+		if updated, err := time.Parse(time.RFC3339, target.UpdatedAt); err == nil {
+			fmt.Fprintf(&out, "codex_autopatch_target_updated_timestamp_seconds{path=\"%s\",editor=\"%s\"} %d\n", promLabel(key), promLabel(target.Editor), updated.Unix())
+		}
+	}
+	return out.String()
+}
+
+func WriteMetrics(metricsPath string, state RunState) error {
+	temp := metricsPath + ".tmp"
+	if err := os.WriteFile(temp, []byte(renderMetrics(state)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp, metricsPath)
+}
+
+func ServeMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("--metrics-listen %s: %s", addr, err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, renderMetrics(LoadState()))
+	})
+	output.Logf("[metrics] serving http://%s/metrics\n", listener.Addr())
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func WriteStats(statsPath string, stats runStats) error {
+	encoded, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	if statsPath == "-" {
+		fmt.Println(string(encoded))
+		return nil
+	}
+	return os.WriteFile(statsPath, append(encoded, '\n'), 0o644)
+}
@@ -0,0 +1,21 @@
+package sinks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestServeMetricsReportsBusyAddress(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("CODEX_AUTOPATCH_HOME", home)
+	t.Setenv("HOME", home)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	if err := ServeMetrics(listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "--metrics-listen") {
+		t.Fatalf("serveMetrics on a busy address: %v", err)
+	}
+}